@@ -0,0 +1,334 @@
+package utfc
+
+import (
+	"fmt"
+	"sort"
+	"unicode"
+)
+
+// SuggestAuxOffset finds the 64-codepoint window within the 128-codepoint alphabet starting at `block`
+// that covers the most characters of str. The result can be used as a value in Options.AuxOffsets.
+// If no characters of str fall into the block, the block itself is returned.
+func SuggestAuxOffset(str string, block int) int {
+	block &= offsMask13Bit
+	counts := [0x80]int{}
+	for _, ch := range str {
+		if cp := int(ch); cp >= block && cp < block+0x80 {
+			counts[cp-block]++
+		}
+	}
+	// Slide the window over the block, keeping the earliest one among equally good
+	covered := 0
+	for _, n := range counts[:0x40] {
+		covered += n
+	}
+	best, bestCovered := 0, covered
+	for i := 1; i <= 0x40; i++ {
+		covered += counts[i+0x3F] - counts[i-1]
+		if covered > bestCovered {
+			best, bestCovered = i, covered
+		}
+	}
+	return block + best
+}
+
+// Needs3Byte returns the characters of str that Encode would encode with 3 bytes (switches to a new 21-bit alphabet),
+// in order of appearance. All other characters take 1 or 2 bytes. The result depends on the context:
+// removing one of these characters may turn the next one (from the same 21-bit alphabet) into a 3-byte one.
+func Needs3Byte(str string) []rune {
+	var runes []rune
+	opts := Options{}
+	st := initState()
+	scratch := [3]byte{}
+	for _, ch := range str {
+		if len(st.encodeRune(scratch[:0], int(ch), &opts)) == 3 {
+			runes = append(runes, ch)
+		}
+	}
+	return runes
+}
+
+// SizeClass returns the number of characters of str that Encode encodes with 1, 2 and 3 bytes respectively,
+// so that n1+2*n2+3*n3 == EncodedLen(str).
+func SizeClass(str string) (n1, n2, n3 int) {
+	opts := Options{}
+	st := initState()
+	scratch := [3]byte{}
+	for _, ch := range str {
+		switch len(st.encodeRune(scratch[:0], int(ch), &opts)) {
+		case 1:
+			n1++
+		case 2:
+			n2++
+		default:
+			n3++
+		}
+	}
+	return
+}
+
+// CorpusSavings returns the total size of strs encoded with Encode and in UTF-8 (i.e. the sum of their byte lengths),
+// e.g. to compute the aggregate savings as 1 - utfcTotal/utf8Total
+func CorpusSavings(strs []string) (utfcTotal, utf8Total int64) {
+	for _, str := range strs {
+		utfcTotal += int64(EncodedLen(str))
+		utf8Total += int64(len(str))
+	}
+	return
+}
+
+// isASCIIPunct reports whether cp is a space or an ASCII punctuation character (anything but letters and digits)
+func isASCIIPunct(cp int) bool {
+	return cp < 0x80 && !(cp >= '0' && cp <= '9') && !(cp >= 'A' && cp <= 'Z') && !(cp >= 'a' && cp <= 'z')
+}
+
+// PunctuationPenalty returns the number of extra bytes Encode spends on spaces and ASCII punctuation embedded in non-Latin text.
+// For each run of such characters it compares the actual size of the run and the character following it
+// with the size they would have if every punctuation character took 1 byte without changing the state.
+func PunctuationPenalty(str string) int {
+	opts := Options{}
+	st := initState()
+	scratch := [3]byte{}
+	penalty := 0
+	inRun, before, actual, ideal := false, st, 0, 0
+	for _, ch := range str {
+		cp := int(ch)
+		if isASCIIPunct(cp) {
+			if !inRun {
+				inRun, before, actual, ideal = true, st, 0, 0
+			}
+			actual += len(st.encodeRune(scratch[:0], cp, &opts))
+			ideal++
+			continue
+		}
+		n := len(st.encodeRune(scratch[:0], cp, &opts))
+		if inRun {
+			// The first character after the run may need to switch back
+			actual += n
+			ideal += len(before.encodeRune(scratch[:0], cp, &opts))
+			if actual > ideal {
+				penalty += actual - ideal
+			}
+			inRun = false
+		}
+	}
+	if inRun && actual > ideal {
+		penalty += actual - ideal
+	}
+	return penalty
+}
+
+// Histogram returns the number of occurrences of each character in str.
+// Together with BlockHistogram and SuggestAuxOffset it helps choosing Options.AuxOffsets for a corpus.
+func Histogram(str string) map[rune]int {
+	counts := make(map[rune]int)
+	for _, ch := range str {
+		counts[ch]++
+	}
+	return counts
+}
+
+// BlockHistogram returns the number of characters of str in each 128-codepoint alphabet, keyed by its start
+// (the same block values that SuggestAuxOffset accepts)
+func BlockHistogram(str string) map[int]int {
+	counts := make(map[int]int)
+	for _, ch := range str {
+		counts[int(ch)&offsMask13Bit]++
+	}
+	return counts
+}
+
+// MinBytes returns a lower bound on the size of Encode(str), useful to estimate how much the greedy encoder
+// leaves on the table. The bound assumes that every alphabet has to be switched to only once (when its first
+// character appears), and after that all of its characters (as well as those of every auxiliary alphabet
+// it could have set) take 1 byte. Characters from the extra ranges which don't change the alphabet always take
+// at least 2 bytes, 21-bit characters take at least 2 bytes, and the first one of each 21-bit alphabet takes 3.
+// The bound is computed for the default options and never exceeds EncodedLen(str).
+func MinBytes(str string) int {
+	blocks := map[int]bool{0: true}         // 13-bit alphabets which could be the current one
+	windows := map[int]bool{}               // 21-bit alphabets which were switched to
+	auxs := map[int]bool{offsInitAux: true} // Offsets of auxiliary alphabets which could be active
+	visit := func(offs int) {
+		auxs[getAuxOffset(offs)] = true
+	}
+	inAux := func(cp int) bool {
+		for offs := range auxs {
+			if (offs == 0 && inRanges(cp, rangesLatin)) || (offs != 0 && cp >= offs && cp <= offs+0x3F) {
+				return true
+			}
+		}
+		return false
+	}
+	opts := Options{}
+	n := 0
+	for _, ch := range str {
+		cp := int(ch)
+		extra := inRanges(cp, rangesExtra)
+		switch {
+		case (cp < min21BitCp || extra) && blocks[cp&offsMask13Bit], inAux(cp):
+			n++
+		case extra:
+			n += 2
+			if opts.switchesOnExtra(cp) {
+				blocks[cp&offsMask13Bit] = true
+				visit(cp & offsMask13Bit)
+			}
+		case cp >= min21BitCp:
+			offs := (cp - min21BitCp) & offsMask21Bit
+			if windows[offs] {
+				n += 2
+			} else {
+				n += 3
+				windows[offs] = true
+				// After leaving a 21-bit alphabet its offset may end up as an auxiliary one, either raw or remapped
+				auxs[offs] = true
+				visit(offs)
+			}
+		default:
+			n += 2
+			offs := cp & offsMask13Bit
+			if cp <= maxLatinCp {
+				offs = 0
+			}
+			blocks[offs] = true
+			visit(offs)
+		}
+	}
+	return n
+}
+
+// encodeSteps encodes str with the default options, calling fn for each character with the state after encoding it
+// and whether the current alphabet was changed
+func encodeSteps(str string, fn func(ch rune, st state, switched bool)) {
+	opts := Options{}
+	st := initState()
+	scratch := [3]byte{}
+	for _, ch := range str {
+		prev := st
+		st.encodeRune(scratch[:0], int(ch), &opts)
+		fn(ch, st, st.offs != prev.offs || st.is21Bit != prev.is21Bit)
+	}
+}
+
+// SwitchCount returns the number of characters of str for which Encode changes the current alphabet
+func SwitchCount(str string) int {
+	n := 0
+	encodeSteps(str, func(ch rune, st state, switched bool) {
+		if switched {
+			n++
+		}
+	})
+	return n
+}
+
+// BlocksUsed returns the distinct alphabets that are current while Encode encodes str, in order of first use.
+// Each is given by its first codepoint, which is the offs value for 13-bit alphabets (0 for Latin, covering U+0000-U+02FF)
+// and offs+0x2800 for 21-bit ones (e.g. 0x2800 for U+2800-U+A7FF). Characters encoded via the auxiliary alphabet
+// or extra ranges (except Hiragana and Katakana) don't use the current alphabet, so e.g. "😀é" uses none.
+// The number of alphabets is a lower bound for SwitchCount (plus 1 if Latin is among them), see MinSwitches.
+func BlocksUsed(str string) []int {
+	opts := Options{}
+	st := initState()
+	scratch := [3]byte{}
+	var blocks []int
+	seen := map[int]bool{}
+	for _, ch := range str {
+		prev := st
+		st.encodeRune(scratch[:0], int(ch), &opts)
+		if st == prev && !st.inCurrent(int(ch)) {
+			continue // Encoded via the auxiliary alphabet or extra ranges
+		}
+		block := st.offs
+		if st.is21Bit {
+			block += min21BitCp
+		}
+		if !seen[block] {
+			seen[block] = true
+			blocks = append(blocks, block)
+		}
+	}
+	return blocks
+}
+
+// MinSwitches returns the number of distinct alphabets Encode uses for str (see BlocksUsed), minus one if Latin
+// is among them, since the initial state is free. Each of the other alphabets takes at least one switch,
+// so it's a lower bound for SwitchCount, and the difference shows how many switches are spent on returning
+// to alphabets that were already used, which grouping text by script could save.
+func MinSwitches(str string) int {
+	n := 0
+	for _, block := range BlocksUsed(str) {
+		if block != 0 {
+			n++
+		}
+	}
+	return n
+}
+
+// scriptName returns the name of the Unicode script of ch, e.g. "Cyrillic" (or "Common" for shared characters)
+func scriptName(ch rune) string {
+	for name, table := range unicode.Scripts {
+		if unicode.Is(table, ch) {
+			return name
+		}
+	}
+	return "Unknown"
+}
+
+// Advise returns human-readable hints on why str encodes inefficiently, or nil if there's nothing to improve.
+// It reports switches (as counted by SwitchCount) back to alphabets that were already used, each costing an extra byte,
+// along with the pair of scripts alternating the most, and the penalty for ASCII punctuation in non-Latin text
+// (see PunctuationPenalty).
+func Advise(str string) []string {
+	visited := map[state]bool{{offs: 0}: true} // The initial alphabet is Latin
+	pairs := map[string]int{}
+	script, afterPunct, returns := "Latin", false, 0
+	encodeSteps(str, func(ch rune, st state, switched bool) {
+		cp := int(ch)
+		alphabet := state{offs: st.offs, is21Bit: st.is21Bit}
+		if switched {
+			// Switches caused by punctuation (and back from it) are accounted by PunctuationPenalty
+			if visited[alphabet] && !isASCIIPunct(cp) && !afterPunct {
+				pair := []string{script, scriptName(ch)}
+				sort.Strings(pair) // Alternation of two scripts is counted regardless of the direction of switches
+				pairs[pair[0]+"/"+pair[1]]++
+				returns++
+			}
+			visited[alphabet] = true
+			script = scriptName(ch)
+		}
+		afterPunct = isASCIIPunct(cp)
+	})
+
+	var hints []string
+	if returns > 1 {
+		// The most frequent pair, the first alphabetically among equal ones
+		names := make([]string, 0, len(pairs))
+		for name := range pairs {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		top := names[0]
+		for _, name := range names {
+			if pairs[name] > pairs[top] {
+				top = name
+			}
+		}
+		if pairs[top] == returns {
+			hints = append(hints, fmt.Sprintf("frequent %v alternation adds %v; consider grouping scripts", top, byteCount(returns)))
+		} else {
+			hints = append(hints, fmt.Sprintf("switches back to used alphabets add %v, most of all %v alternation (%v); consider grouping scripts",
+				byteCount(returns), top, byteCount(pairs[top])))
+		}
+	}
+	if penalty := PunctuationPenalty(str); penalty > 0 {
+		hints = append(hints, fmt.Sprintf("spaces and ASCII punctuation inside non-Latin text add %v; consider native punctuation or grouping scripts", byteCount(penalty)))
+	}
+	return hints
+}
+
+func byteCount(n int) string {
+	if n == 1 {
+		return "1 byte"
+	}
+	return fmt.Sprintf("%v bytes", n)
+}
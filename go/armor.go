@@ -0,0 +1,74 @@
+package utfc
+
+import (
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+)
+
+// EncodeASCII converts string to UTF-C and armors the result with unpadded base64url,
+// so it can be passed through channels that only allow 7-bit ASCII.
+// The armor takes 4 characters per every 3 bytes of UTF-C output (rounded up), i.e. adds about 33%.
+func EncodeASCII(str string) string {
+	return base64.RawURLEncoding.EncodeToString(Encode(str))
+}
+
+// DecodeASCII converts a string produced by EncodeASCII back to the original one
+func DecodeASCII(s string) (string, error) {
+	buf, err := base64.RawURLEncoding.DecodeString(s)
+	if err != nil {
+		return "", err
+	}
+	return DecodeSafe(buf)
+}
+
+// EncodeHex converts string to UTF-C and returns the result as lowercase hex
+func EncodeHex(str string) string {
+	return hex.EncodeToString(Encode(str))
+}
+
+// DecodeHex converts hex-encoded UTF-C data back to a string.
+// Malformed hex is reported with the errors of encoding/hex, malformed UTF-C with a *DecodeError.
+func DecodeHex(s string) (string, error) {
+	buf, err := hex.DecodeString(s)
+	if err != nil {
+		return "", err
+	}
+	return DecodeSafe(buf)
+}
+
+// EncodeBase64 converts string to UTF-C and returns the result as standard (padded) base64.
+// Unlike EncodeASCII, the output is suitable for tools and logs that expect the standard alphabet.
+func EncodeBase64(str string) string {
+	return base64.StdEncoding.EncodeToString(Encode(str))
+}
+
+// DecodeBase64 converts standard base64-encoded UTF-C data back to a string.
+// Malformed base64 is reported with base64.CorruptInputError, malformed UTF-C with a *DecodeError.
+func DecodeBase64(s string) (string, error) {
+	buf, err := base64.StdEncoding.DecodeString(s)
+	if err != nil {
+		return "", err
+	}
+	return DecodeSafe(buf)
+}
+
+// ErrNotDoubleEncoded is returned by DecodeDouble when the data doesn't look like encoded twice
+var ErrNotDoubleEncoded = errors.New("utfc: data is not double-encoded")
+
+// DecodeDouble recovers a string that was encoded twice, i.e. Encode(s) was interpreted as a Latin-1 string
+// and encoded again. An error is returned if either of decoding steps fails.
+func DecodeDouble(buf []byte) (string, error) {
+	outer, err := DecodeSafe(buf)
+	if err != nil {
+		return "", err
+	}
+	inner := make([]byte, 0, len(outer))
+	for _, ch := range outer {
+		if ch > 0xFF {
+			return "", ErrNotDoubleEncoded
+		}
+		inner = append(inner, byte(ch))
+	}
+	return DecodeSafe(inner)
+}
@@ -0,0 +1,95 @@
+package utfc
+
+import (
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"testing"
+)
+
+func TestASCII(t *testing.T) {
+	for _, test := range testStrings {
+		armored := EncodeASCII(test)
+		for i := 0; i < len(armored); i++ {
+			if armored[i] >= 0x80 {
+				t.Fatalf("String '%v' armored with non-ASCII byte 0x%02X", test, armored[i])
+			}
+		}
+		if ctrl, err := DecodeASCII(armored); err != nil || ctrl != test {
+			t.Errorf("String '%v' decoded back as '%v' (%v)", test, ctrl, err)
+		}
+		if n, expected := len(armored), (len(Encode(test))*4+2)/3; n != expected {
+			t.Errorf("String '%v' armored into %v characters, expected %v", test, n, expected)
+		}
+	}
+	if _, err := DecodeASCII("not base64!"); err == nil {
+		t.Errorf("Expected error for malformed input")
+	}
+}
+
+func TestHexBase64(t *testing.T) {
+	for _, test := range testStrings {
+		if ctrl, err := DecodeHex(EncodeHex(test)); err != nil || ctrl != test {
+			t.Errorf("String '%v' decoded back from hex as '%v' (%v)", test, ctrl, err)
+		}
+		if ctrl, err := DecodeBase64(EncodeBase64(test)); err != nil || ctrl != test {
+			t.Errorf("String '%v' decoded back from base64 as '%v' (%v)", test, ctrl, err)
+		}
+	}
+	if s := EncodeHex("Мир"); s != "841c3840" {
+		t.Errorf("Unexpected hex %v", s)
+	}
+	if s := EncodeBase64("Мир"); s != "hBw4QA==" {
+		t.Errorf("Unexpected base64 %v", s)
+	}
+
+	// Malformed outer encodings
+	var invalidByte hex.InvalidByteError
+	if _, err := DecodeHex("84zz"); !errors.As(err, &invalidByte) {
+		t.Errorf("Expected hex.InvalidByteError, got %v", err)
+	}
+	if _, err := DecodeHex("841"); err != hex.ErrLength {
+		t.Errorf("Expected hex.ErrLength, got %v", err)
+	}
+	var corrupt base64.CorruptInputError
+	if _, err := DecodeBase64("hBw4QA"); !errors.As(err, &corrupt) {
+		t.Errorf("Expected base64.CorruptInputError for missing padding, got %v", err)
+	}
+	if _, err := DecodeBase64("hBw4Q-=="); !errors.As(err, &corrupt) {
+		t.Errorf("Expected base64.CorruptInputError for URL alphabet, got %v", err)
+	}
+	// Well-formed outer encoding of malformed UTF-C
+	var decodeErr *DecodeError
+	if str, err := DecodeHex("61a000"); !errors.As(err, &decodeErr) || decodeErr.Err != ErrTruncated || decodeErr.Offset != 1 || str != "a" {
+		t.Errorf("Expected truncation at offset 1, got '%v' (%v)", str, err)
+	}
+	if _, err := DecodeBase64("v/8="); !errors.Is(err, ErrInvalid) {
+		t.Errorf("Expected ErrInvalid, got %v", err)
+	}
+}
+
+func latin1(buf []byte) string {
+	runes := make([]rune, len(buf))
+	for i, b := range buf {
+		runes[i] = rune(b)
+	}
+	return string(runes)
+}
+
+func TestDecodeDouble(t *testing.T) {
+	for _, test := range testStrings {
+		buf := Encode(latin1(Encode(test)))
+		if ctrl, err := DecodeDouble(buf); err != nil || ctrl != test {
+			t.Errorf("String '%v' decoded back as '%v' (%v)", test, ctrl, err)
+		}
+	}
+
+	// Data encoded once contains characters outside of Latin-1
+	if _, err := DecodeDouble(Encode("Словарь")); err != ErrNotDoubleEncoded {
+		t.Errorf("Expected ErrNotDoubleEncoded, got %v", err)
+	}
+	// Inner data is truncated
+	if _, err := DecodeDouble(Encode(latin1([]byte{'a', marker21Bit}))); !errors.Is(err, ErrTruncated) {
+		t.Errorf("Expected ErrTruncated, got %v", err)
+	}
+}
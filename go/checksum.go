@@ -0,0 +1,71 @@
+package utfc
+
+import (
+	"encoding/binary"
+	"errors"
+	"hash/crc32"
+	"unicode/utf8"
+)
+
+// ErrChecksumMismatch is returned by DecodeChecksummed if the data doesn't match its checksum
+var ErrChecksumMismatch = errors.New("utfc: checksum mismatch")
+
+// Size of the checksum appended by EncodeChecksummed
+const checksumSize = 4
+
+// EncodeChecksummed converts string to an UTF-C byte array followed by CRC-32 (IEEE, big-endian) of the encoded bytes
+func EncodeChecksummed(str string) []byte {
+	buf := AppendEncode(make([]byte, 0, len(str)+checksumSize), str)
+	var sum [checksumSize]byte
+	binary.BigEndian.PutUint32(sum[:], crc32.ChecksumIEEE(buf))
+	return append(buf, sum[:]...)
+}
+
+// DecodeChecksummed verifies the checksum appended by EncodeChecksummed and decodes the data.
+// The checksum is checked before decoding, so corrupted data results in ErrChecksumMismatch
+// (buffers too short to contain a checksum are reported as such too).
+// Data with a valid checksum can still be malformed, in that case a *DecodeError is returned.
+func DecodeChecksummed(buf []byte) (string, error) {
+	if len(buf) < checksumSize {
+		return "", ErrChecksumMismatch
+	}
+	data := buf[:len(buf)-checksumSize]
+	if crc32.ChecksumIEEE(data) != binary.BigEndian.Uint32(buf[len(data):]) {
+		return "", ErrChecksumMismatch
+	}
+	return DecodeSafe(data)
+}
+
+// Parameters of 64-bit FNV-1a hash (the same as in hash/fnv)
+const (
+	fnvOffset64 = 14695981039346656037
+	fnvPrime64  = 1099511628211
+)
+
+// ContentHash returns 64-bit FNV-1a hash of the UTF-8 text encoded in buf, without building the decoded string.
+// It depends only on the text, so it's the same for any buffers that Decode to equal strings (e.g. encoded with
+// MinimizeSwitches or SimpleAstral, or by other implementations), and equals the FNV-1a hash of the text itself.
+// Malformed data results in a *DecodeError, as with DecodeSafe.
+func ContentHash(buf []byte) (uint64, error) {
+	return ContentHashWith(buf, Options{})
+}
+
+// ContentHashWith is like ContentHash, but decodes buf using the given options (as DecodeWith does),
+// so data encoded with any options hashes the same as Encode of its text.
+func ContentHashWith(buf []byte, opts Options) (uint64, error) {
+	if err := opts.Validate(); err != nil {
+		return 0, err
+	}
+	hash := uint64(fnvOffset64)
+	var scratch [utf8.UTFMax]byte
+	err := decodeEach(buf, currentFormat, &opts, func(cp int) {
+		for _, b := range scratch[:utf8.EncodeRune(scratch[:], rune(cp))] {
+			hash ^= uint64(b)
+			hash *= fnvPrime64
+		}
+	})
+	if err != nil {
+		return 0, err
+	}
+	return hash, nil
+}
@@ -0,0 +1,95 @@
+package utfc
+
+import (
+	"bytes"
+	"errors"
+	"hash/fnv"
+	"testing"
+)
+
+func TestChecksum(t *testing.T) {
+	for _, test := range testStrings {
+		buf := EncodeChecksummed(test)
+		if !bytes.Equal(buf[:len(buf)-checksumSize], Encode(test)) {
+			t.Errorf("String '%v' encoded as %v, expected %v followed by checksum", test, hexString(buf), hexString(Encode(test)))
+		}
+		if ctrl, err := DecodeChecksummed(buf); err != nil || ctrl != test {
+			t.Errorf("String '%v' decoded back as '%v' (%v)", test, ctrl, err)
+		}
+	}
+
+	buf := EncodeChecksummed("Привет, мир")
+	for i := 0; i < len(buf)*8; i++ {
+		corrupted := append([]byte{}, buf...)
+		corrupted[i/8] ^= 1 << (i % 8)
+		if _, err := DecodeChecksummed(corrupted); err != ErrChecksumMismatch {
+			t.Errorf("Flipped bit %v: expected ErrChecksumMismatch, got %v", i, err)
+		}
+	}
+	if _, err := DecodeChecksummed([]byte{0, 0, 0}); err != ErrChecksumMismatch {
+		t.Errorf("Expected ErrChecksumMismatch for a short buffer, got %v", err)
+	}
+
+	// Valid checksum of malformed data
+	buf = EncodeChecksummed("")
+	buf = append([]byte{0x80}, buf...)
+	if _, err := DecodeChecksummed(buf); err != ErrChecksumMismatch {
+		t.Errorf("Expected ErrChecksumMismatch, got %v", err)
+	}
+	buf = []byte{0x80, 0x3F, 0xBA, 0x6C, 0xAD} // 0x80 followed by its CRC-32
+	if _, err := DecodeChecksummed(buf); !errors.Is(err, ErrTruncated) {
+		t.Errorf("Expected ErrTruncated, got %v", err)
+	}
+}
+
+func TestContentHash(t *testing.T) {
+	strs := append([]string{"日本語のひらがなとカタカナ", "🔥🔥 emoji 😀"}, testStrings...)
+	for _, test := range strs {
+		expected := fnv.New64a()
+		expected.Write([]byte(test))
+		if hash, err := ContentHash(Encode(test)); err != nil || hash != expected.Sum64() {
+			t.Errorf("String '%v' hashed as %x (%v), expected %x", test, hash, err, expected.Sum64())
+		}
+		// Buffers encoded differently, but decoded to the same text, have the same hash,
+		// and so does the canonical encoding (as produced by Encode) of each of them
+		for _, opts := range []Options{{MinimizeSwitches: true}, {SimpleAstral: true}} {
+			buf, _ := EncodeWith(test, opts)
+			canonical, err := Reencode(buf, opts, Options{})
+			if err != nil || !bytes.Equal(canonical, Encode(test)) {
+				t.Errorf("String '%v' reencoded as %v (%v)", test, hexString(canonical), err)
+			}
+			for _, b := range [][]byte{buf, canonical} {
+				if hash, err := ContentHash(b); err != nil || hash != expected.Sum64() {
+					t.Errorf("String '%v' encoded with %+v as %v hashed as %x (%v), expected %x", test, opts, hexString(b), hash, err, expected.Sum64())
+				}
+			}
+		}
+	}
+	// Data that can only be decoded with the options it was encoded with
+	for _, opts := range []Options{
+		{DenseEmoji: true},
+		{EscapeNewlines: true, RestartInterval: 3},
+		{PrivateWindow: 0xE000, AuxOffsets: map[int]int{0x0400: 0x0400}, LatinAux: [][]int{{'a', 'z' + 1}}},
+	} {
+		for _, test := range append([]string{"🔥🔥 emoji 😀\nline", "\uE000\uE001 Жизнь\n"}, testStrings...) {
+			expected, _ := ContentHash(Encode(test))
+			buf, _ := EncodeWith(test, opts)
+			if hash, err := ContentHashWith(buf, opts); err != nil || hash != expected {
+				t.Errorf("String '%v' encoded with %+v hashed as %x (%v), expected %x", test, opts, hash, err, expected)
+			}
+		}
+	}
+	if _, err := ContentHashWith(nil, Options{RestartInterval: -1}); err != ErrInvalidRestartInterval {
+		t.Errorf("Expected ErrInvalidRestartInterval, got %v", err)
+	}
+
+	h1, _ := ContentHash(Encode("Привет"))
+	h2, _ := ContentHash(Encode("Привет!"))
+	if h1 == h2 {
+		t.Errorf("Different strings have the same hash %x", h1)
+	}
+	var decodeErr *DecodeError
+	if _, err := ContentHash([]byte{'a', 0xBF, 0xFF}); !errors.As(err, &decodeErr) || decodeErr.Offset != 1 {
+		t.Errorf("Expected ErrInvalid at offset 1, got %v", err)
+	}
+}
@@ -0,0 +1,91 @@
+package utfc
+
+import (
+	"errors"
+	"unicode/utf8"
+)
+
+// State is the state of the encoder (or decoder) between characters. It allows continuing encoding
+// where the previous string ended, which is useful for columns of similar values.
+// The zero value is the initial state used by Encode and Decode.
+type State struct {
+	st  state
+	set bool // False for the zero value, which means initState()
+}
+
+func (s State) get() state {
+	if !s.set {
+		return initState()
+	}
+	return s.st
+}
+
+// stateSize is the size of a marshaled State: 3 bytes of offs, 3 bytes of auxOffs and a byte of flags
+const stateSize = 7
+
+// ErrInvalidState is returned by State.UnmarshalBinary if the data doesn't hold a valid state
+var ErrInvalidState = errors.New("utfc: invalid state")
+
+// MarshalBinary implements encoding.BinaryMarshaler. The result takes 7 bytes and doesn't depend on options.
+func (s State) MarshalBinary() ([]byte, error) {
+	st := s.get()
+	flags := byte(0)
+	if st.is21Bit {
+		flags = 1
+	}
+	return []byte{byte(st.offs >> 16), byte(st.offs >> 8), byte(st.offs),
+		byte(st.auxOffs >> 16), byte(st.auxOffs >> 8), byte(st.auxOffs), flags}, nil
+}
+
+// UnmarshalBinary implements encoding.BinaryUnmarshaler, restoring a state written by MarshalBinary
+func (s *State) UnmarshalBinary(data []byte) error {
+	if len(data) != stateSize || data[6] > 1 {
+		return ErrInvalidState
+	}
+	st := state{
+		offs:    int(data[0])<<16 | int(data[1])<<8 | int(data[2]),
+		auxOffs: int(data[3])<<16 | int(data[4])<<8 | int(data[5]),
+		is21Bit: data[6] == 1,
+	}
+	// Same checks as assertValid in debug builds
+	if st.is21Bit && (st.offs&^offsMask21Bit != 0 || st.offs+min21BitCp > utf8.MaxRune) {
+		return ErrInvalidState
+	} else if !st.is21Bit && (st.offs&^offsMask13Bit != 0 || st.offs > utf8.MaxRune) {
+		return ErrInvalidState
+	} else if st.auxOffs > utf8.MaxRune-min21BitCp {
+		return ErrInvalidState
+	}
+	*s = State{st: st, set: true}
+	return nil
+}
+
+// EncodeColumn converts string to an UTF-C byte array starting from the state prev, and returns
+// the state after it. Consecutive cells in the same script avoid repeated switches to their alphabet.
+// The result can only be decoded by DecodeColumn with the same prev state, so cells must be decoded in order.
+func EncodeColumn(prev State, str string) (buf []byte, next State) {
+	st := prev.get()
+	opts := Options{}
+	buf = make([]byte, 0, len(str))
+	for _, ch := range str {
+		buf = st.encodeRune(buf, int(ch), &opts)
+	}
+	return buf, State{st: st, set: true}
+}
+
+// DecodeColumn converts UTF-C byte array produced by EncodeColumn back to a string, starting from the state prev.
+// It returns the state after the last decoded character, to be passed for the next cell.
+// Like Decode, it replaces invalid codepoints with U+FFFD and ignores a truncated sequence at the end.
+func DecodeColumn(prev State, buf []byte) (string, State) {
+	st := prev.get()
+	opts := Options{}
+	out := make([]byte, 0, len(buf))
+	for i := 0; i < len(buf); {
+		cp, n, err := st.decodeRune(buf, i, &opts)
+		if err != nil {
+			break
+		}
+		i += n
+		out = appendRune(out, cp)
+	}
+	return string(out), State{st: st, set: true}
+}
@@ -0,0 +1,94 @@
+package utfc
+
+import (
+	"bytes"
+	"encoding"
+	"testing"
+)
+
+func TestColumn(t *testing.T) {
+	// The zero State is the initial one
+	for _, test := range testStrings {
+		if buf, _ := EncodeColumn(State{}, test); !bytes.Equal(buf, Encode(test)) {
+			t.Errorf("String '%v' encoded as %v, expected %v", test, hexString(buf), hexString(Encode(test)))
+		}
+	}
+
+	cells := []string{"Москва", "Санкт-Петербург", "Новосибирск", "", "Екатеринбург", "Казань", "Tokyo", "Нижний Новгород"}
+	var enc, dec State
+	total, independent := 0, 0
+	for _, cell := range cells {
+		var buf []byte
+		buf, enc = EncodeColumn(enc, cell)
+		total += len(buf)
+		independent += len(Encode(cell))
+
+		var str string
+		str, dec = DecodeColumn(dec, buf)
+		if str != cell {
+			t.Errorf("Cell '%v' decoded back as '%v', bytes: %v", cell, str, hexString(buf))
+		}
+		if dec != enc {
+			t.Errorf("Cell '%v': decoder state %+v differs from encoder state %+v", cell, dec, enc)
+		}
+	}
+	if total >= independent {
+		t.Errorf("Column encoding took %v bytes, independent encoding %v", total, independent)
+	}
+}
+
+func TestStateMarshal(t *testing.T) {
+	var _ encoding.BinaryMarshaler = State{}
+	var _ encoding.BinaryUnmarshaler = &State{}
+
+	// Checkpoint the state after every part, restore it and continue: the stream must match a single pass
+	parts := []string{"Привет", " мир", ", 日本語", "🔥 ", "ひらがな", "\U0010FFFF", "Ελλάδα", "abc", ""}
+	for checkpoint := range parts {
+		var stream []byte
+		var st State
+		for i, part := range parts {
+			var buf []byte
+			buf, st = EncodeColumn(st, part)
+			stream = append(stream, buf...)
+			if i == checkpoint {
+				data, err := st.MarshalBinary()
+				if err != nil || len(data) != stateSize {
+					t.Fatalf("State %+v marshaled as %v (%v)", st, hexString(data), err)
+				}
+				var restored State
+				if err := restored.UnmarshalBinary(data); err != nil || restored.get() != st.get() {
+					t.Fatalf("State %+v unmarshaled as %+v (%v)", st, restored, err)
+				}
+				st = restored
+			}
+		}
+		all := ""
+		for _, part := range parts {
+			all += part
+		}
+		if !bytes.Equal(stream, Encode(all)) {
+			t.Errorf("Checkpoint after part %v produced %v, expected %v", checkpoint, hexString(stream), hexString(Encode(all)))
+		}
+	}
+
+	// The zero value is marshaled as the initial state
+	if data, _ := (State{}).MarshalBinary(); !bytes.Equal(data, []byte{0x00, 0x00, 0x00, 0x00, 0x00, 0xC0, 0x00}) {
+		t.Errorf("Zero State marshaled as %v", hexString(data))
+	}
+	for _, data := range [][]byte{
+		nil,
+		{0x00, 0x00, 0x00, 0x00, 0x00, 0xC0},
+		{0x00, 0x00, 0x00, 0x00, 0x00, 0xC0, 0x02},       // Unknown flag
+		{0x00, 0x04, 0x01, 0x00, 0x00, 0xC0, 0x00},       // 13-bit alphabet is not aligned
+		{0x00, 0x40, 0x00, 0x00, 0x00, 0xC0, 0x01},       // 21-bit alphabet is not aligned
+		{0x11, 0x00, 0x00, 0x00, 0x00, 0xC0, 0x00},       // Past the end of Unicode
+		{0x11, 0x00, 0x00, 0x00, 0x00, 0xC0, 0x01},       // 21-bit alphabet past the end of Unicode
+		{0x00, 0x00, 0x00, 0xFF, 0xFF, 0xFF, 0x00},       // Auxiliary alphabet past the end of Unicode
+		{0x00, 0x00, 0x00, 0x00, 0x00, 0xC0, 0x00, 0x00}, // Extra byte
+	} {
+		var st State
+		if err := st.UnmarshalBinary(data); err != ErrInvalidState {
+			t.Errorf("Data %v unmarshaled as %+v (%v), expected ErrInvalidState", hexString(data), st, err)
+		}
+	}
+}
@@ -0,0 +1,85 @@
+package utfc
+
+import "errors"
+
+// ErrNotTerminated is returned by DecodeCString if the buffer has no NUL terminator
+var ErrNotTerminated = errors.New("utfc: missing NUL terminator")
+
+// Zero bytes are produced not only for U+0000, but for any character at the start of the current alphabet
+// (e.g. U+0400 in Cyrillic text), and they are common in the lower bytes of 2- and 3-byte sequences.
+// So C strings hold UTF-C data stuffed with COBS (Consistent Overhead Byte Stuffing): the data is split
+// into blocks ending with a zero byte (which is dropped) or having 254 non-zero bytes, and each block is prefixed
+// with its length + 1. This takes 1 extra byte per every 254 bytes (rounded up) and the terminator.
+// To eliminate another byte value (like newline for Options.EscapeNewlines), blocks end with that value instead,
+// and their length codes are XORed with it.
+
+// maxStuffedBlock is the length code of a block of 254 non-zero bytes not followed by a zero
+const maxStuffedBlock = 0xFF
+
+// stuffBytes appends buf stuffed with COBS to out, so that the appended data contains no delim bytes
+func stuffBytes(out, buf []byte, delim byte) []byte {
+	codeAt, code := len(out), byte(1)
+	out = append(out, 0)
+	for _, b := range buf {
+		if b != delim {
+			out = append(out, b)
+			code++
+			if code != maxStuffedBlock {
+				continue
+			}
+		}
+		out[codeAt] = code ^ delim
+		codeAt, code = len(out), 1
+		out = append(out, 0)
+	}
+	out[codeAt] = code ^ delim
+	return out
+}
+
+// unstuffBytes reverses stuffBytes, returning a *DecodeError with an offset in buf if the stuffing is invalid
+func unstuffBytes(buf []byte, delim byte) ([]byte, error) {
+	data := make([]byte, 0, len(buf))
+	for i := 0; i < len(buf); {
+		code := int(buf[i] ^ delim)
+		if code == 0 || i+code > len(buf) {
+			return nil, &DecodeError{Offset: i, Err: ErrInvalid}
+		}
+		for _, b := range buf[i+1 : i+code] {
+			if b == delim {
+				return nil, &DecodeError{Offset: i, Err: ErrInvalid}
+			}
+		}
+		data = append(data, buf[i+1:i+code]...)
+		i += code
+		if code != maxStuffedBlock && i < len(buf) {
+			data = append(data, delim)
+		}
+	}
+	return data, nil
+}
+
+// EncodeCString converts string to a NUL-terminated buffer without interior NUL bytes, holding UTF-C data
+// stuffed with COBS. U+0000 characters in str are preserved.
+func EncodeCString(str string) []byte {
+	buf := Encode(str)
+	out := stuffBytes(make([]byte, 0, len(buf)+len(buf)/(maxStuffedBlock-1)+2), buf, 0)
+	return append(out, 0)
+}
+
+// DecodeCString converts a buffer produced by EncodeCString back to a string, reading up to the first NUL byte.
+// It returns ErrNotTerminated if there's no NUL byte, and a *DecodeError for malformed data. Offsets of invalid
+// stuffing refer to buf, while offsets of malformed UTF-C refer to the data after unstuffing.
+func DecodeCString(buf []byte) (string, error) {
+	end := 0
+	for end < len(buf) && buf[end] != 0 {
+		end++
+	}
+	if end == len(buf) {
+		return "", ErrNotTerminated
+	}
+	data, err := unstuffBytes(buf[:end], 0)
+	if err != nil {
+		return "", err
+	}
+	return DecodeSafe(data)
+}
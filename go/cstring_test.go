@@ -0,0 +1,48 @@
+package utfc
+
+import (
+	"bytes"
+	"errors"
+	"strings"
+	"testing"
+)
+
+func TestCString(t *testing.T) {
+	strs := append([]string{
+		"", "\x00", "\x00\x00", "a\x00b", "Ѐ\x00Ѐ", // U+0400 is a zero byte in Cyrillic text
+		"Āā\U00012800", // Zero bytes in 2- and 3-byte sequences
+		strings.Repeat("x", 253), strings.Repeat("x", 254), strings.Repeat("x", 255), strings.Repeat("x", 600),
+		strings.Repeat("x", 254) + "\x00", strings.Repeat("\x00", 300),
+	}, testStrings...)
+	for _, str := range strs {
+		buf := EncodeCString(str)
+		if i := bytes.IndexByte(buf, 0); i != len(buf)-1 {
+			t.Errorf("String %+q encoded with a NUL byte at %v of %v: %v", str, i, len(buf), hexString(buf))
+		}
+		if n := len(Encode(str)); len(buf) > n+n/254+2 {
+			t.Errorf("String %+q encoded with %v bytes, expected at most %v", str, len(buf), n+n/254+2)
+		}
+		if ctrl, err := DecodeCString(buf); err != nil || ctrl != str {
+			t.Errorf("String %+q decoded back as %+q (%v)", str, ctrl, err)
+		}
+		// Everything past the terminator is ignored
+		if ctrl, err := DecodeCString(append(buf, 'x', 0)); err != nil || ctrl != str {
+			t.Errorf("String %+q with a tail decoded back as %+q (%v)", str, ctrl, err)
+		}
+	}
+	// UTF-C bytes are 61 00 84 00
+	if buf := EncodeCString("a\x00Ѐ"); !bytes.Equal(buf, []byte{0x02, 'a', 0x02, 0x84, 0x01, 0x00}) {
+		t.Errorf("Unexpected encoding %v", hexString(buf))
+	}
+
+	if _, err := DecodeCString([]byte{0x02, 'a'}); err != ErrNotTerminated {
+		t.Errorf("Expected ErrNotTerminated, got %v", err)
+	}
+	var decodeErr *DecodeError
+	if _, err := DecodeCString([]byte{0x03, 'a', 0x00}); !errors.As(err, &decodeErr) || decodeErr.Offset != 0 || decodeErr.Err != ErrInvalid {
+		t.Errorf("Expected ErrInvalid at offset 0, got %v", err)
+	}
+	if _, err := DecodeCString([]byte{0x02, 'a', 0x02, marker21Bit, 0x00}); !errors.As(err, &decodeErr) || decodeErr.Offset != 2 || decodeErr.Err != ErrTruncated {
+		t.Errorf("Expected ErrTruncated at offset 2, got %v", err)
+	}
+}
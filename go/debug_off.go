@@ -0,0 +1,9 @@
+//go:build !utfc_debug
+// +build !utfc_debug
+
+package utfc
+
+// Without the utfc_debug build tag invariants are not checked (see debug_on.go)
+func (st *state) assertValid(opts *Options) {}
+
+func assertAdvance(i, n, length int) {}
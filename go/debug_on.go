@@ -0,0 +1,47 @@
+//go:build utfc_debug
+// +build utfc_debug
+
+package utfc
+
+import (
+	"fmt"
+	"unicode/utf8"
+)
+
+// assertValid panics if the state could not have been produced by the encoder or decoder with the given options.
+// With the utfc_debug build tag it's called before encoding or decoding each character; the output is identical to the regular build.
+func (st *state) assertValid(opts *Options) {
+	if st.is21Bit {
+		if st.offs&^offsMask21Bit != 0 || st.offs+min21BitCp > 0x10FFFF {
+			panic(fmt.Sprintf("utfc: invalid 21-bit alphabet in state %+v", *st))
+		}
+	} else if st.offs&^offsMask13Bit != 0 || (st.offs >= min21BitCp && !switchesTo13Bit(st.offs, opts)) {
+		panic(fmt.Sprintf("utfc: invalid 13-bit alphabet in state %+v", *st))
+	}
+	// Auxiliary alphabet can start at a raw 21-bit offset (see encodeRune) or at the alphabet of the private window,
+	// but can't go past the end of Unicode
+	if st.auxOffs < 0 || st.auxOffs > utf8.MaxRune-0x3F {
+		panic(fmt.Sprintf("utfc: invalid auxiliary alphabet in state %+v", *st))
+	}
+}
+
+// switchesTo13Bit reports whether a 13-bit alphabet starting from min21BitCp or above can become the current one:
+// it has to contain extra range characters that change the alphabet, or the private window
+func switchesTo13Bit(offs int, opts *Options) bool {
+	if opts.PrivateWindow != 0 && offs == opts.PrivateWindow&offsMask13Bit {
+		return true
+	}
+	for _, cp := range []int{offs, offs + 0x7F} { // Ranges that change the alphabet cover its start or its end
+		if inRanges(cp, rangesExtra) && opts.switchesOnExtra(cp) {
+			return true
+		}
+	}
+	return false
+}
+
+// assertAdvance panics unless decoding a sequence of n bytes at buf[i] moves forward and stays within the buffer
+func assertAdvance(i, n, length int) {
+	if n <= 0 || i+n > length {
+		panic(fmt.Sprintf("utfc: sequence of %v bytes at offset %v of %v", n, i, length))
+	}
+}
@@ -0,0 +1,59 @@
+//go:build utfc_debug
+// +build utfc_debug
+
+package utfc
+
+import "testing"
+
+// Run with: go test -tags utfc_debug
+func TestDebugAssertions(t *testing.T) {
+	// Encoding and decoding check invariants for every character
+	for _, test := range testStrings {
+		if ctrl := Decode(Encode(test)); ctrl != test {
+			t.Errorf("String '%v' decoded back as '%v'", test, ctrl)
+		}
+	}
+
+	for _, st := range []state{
+		{offs: 0x0401, auxOffs: offsInitAux},
+		{offs: 0x2800, auxOffs: offsInitAux},
+		{offs: 0x110000, auxOffs: offsInitAux},
+		{offs: 0x1F100, auxOffs: offsInitAux},  // Only with DenseEmoji
+		{offs: 0x10FF80, auxOffs: offsInitAux}, // Only with PrivateWindow
+		{offs: 0x0003, auxOffs: 0, is21Bit: true},
+		{offs: 0x0400, auxOffs: -1},
+	} {
+		func() {
+			defer func() {
+				if recover() == nil {
+					t.Errorf("Invalid state %+v was not detected", st)
+				}
+			}()
+			st.encodeRune(nil, 'a', &Options{})
+		}()
+	}
+
+	// Alphabets of extra ranges and the private window are valid with the corresponding options,
+	// including the last window of Unicode, which becomes the auxiliary alphabet after leaving it
+	for _, test := range []struct {
+		str  string
+		opts Options
+	}{
+		{"\U0001F170\U0001F171 ok", Options{DenseEmoji: true}},
+		{"\U0010FFC0Жa\U0010FFFF\U0010FFC1", Options{PrivateWindow: 0x10FFC0}},
+		{"\U000F0000ひ\U000F003F", Options{PrivateWindow: 0xF0000}},
+	} {
+		buf, err := EncodeWith(test.str, test.opts)
+		if ctrl, derr := DecodeWith(buf, test.opts); err != nil || derr != nil || ctrl != test.str {
+			t.Errorf("String %+q decoded back as %+q (%v, %v)", test.str, ctrl, err, derr)
+		}
+	}
+	func() {
+		defer func() {
+			if recover() == nil {
+				t.Errorf("Zero-length sequence was not detected")
+			}
+		}()
+		assertAdvance(0, 0, 1)
+	}()
+}
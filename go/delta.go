@@ -0,0 +1,61 @@
+package utfc
+
+import (
+	"encoding/binary"
+	"errors"
+	"unicode/utf8"
+)
+
+// ErrDeltaMismatch is returned by DecodeDelta if the delta refers to more data than the previous string has
+var ErrDeltaMismatch = errors.New("utfc: delta does not match the previous string")
+
+// EncodeDelta encodes cur relative to prev: the lengths (in UTF-8 bytes) of their common prefix and suffix
+// as unsigned varints, followed by UTF-C encoding of the changed part of cur.
+// For small edits of large strings the result is much shorter than Encode(cur).
+func EncodeDelta(prev, cur string) []byte {
+	prefix := 0
+	for prefix < len(prev) && prefix < len(cur) && prev[prefix] == cur[prefix] {
+		prefix++
+	}
+	// Don't split characters, so the changed part is valid UTF-8
+	for prefix > 0 && prefix < len(cur) && !utf8.RuneStart(cur[prefix]) {
+		prefix--
+	}
+	suffix := 0
+	for suffix < len(prev)-prefix && suffix < len(cur)-prefix && prev[len(prev)-1-suffix] == cur[len(cur)-1-suffix] {
+		suffix++
+	}
+	for suffix > 0 && !utf8.RuneStart(cur[len(cur)-suffix]) {
+		suffix--
+	}
+
+	buf := make([]byte, 2*binary.MaxVarintLen64, 2*binary.MaxVarintLen64+len(cur)-prefix-suffix)
+	n := binary.PutUvarint(buf, uint64(prefix))
+	n += binary.PutUvarint(buf[n:], uint64(suffix))
+	return AppendEncode(buf[:n], cur[prefix:len(cur)-suffix])
+}
+
+// DecodeDelta reconstructs the string from prev and a delta produced by EncodeDelta(prev, cur).
+// It returns ErrDeltaMismatch if the delta can't be applied to prev, and a *DecodeError if it's malformed.
+func DecodeDelta(prev string, delta []byte) (string, error) {
+	prefix, n := binary.Uvarint(delta)
+	if n <= 0 {
+		return "", &DecodeError{Offset: 0, Err: ErrTruncated}
+	}
+	suffix, m := binary.Uvarint(delta[n:])
+	if m <= 0 {
+		return "", &DecodeError{Offset: n, Err: ErrTruncated}
+	}
+	if prefix > uint64(len(prev)) || suffix > uint64(len(prev))-prefix {
+		return "", ErrDeltaMismatch
+	}
+	middle, err := DecodeSafe(delta[n+m:])
+	if err != nil {
+		var decodeErr *DecodeError
+		if errors.As(err, &decodeErr) {
+			return "", &DecodeError{Offset: n + m + decodeErr.Offset, Err: decodeErr.Err}
+		}
+		return "", err
+	}
+	return prev[:prefix] + middle + prev[len(prev)-int(suffix):], nil
+}
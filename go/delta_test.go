@@ -0,0 +1,56 @@
+package utfc
+
+import (
+	"errors"
+	"strings"
+	"testing"
+)
+
+func TestDelta(t *testing.T) {
+	doc := testStrings[39]
+	runes := []rune(doc)
+	edit := func(pos, del int, ins string) string {
+		return string(runes[:pos]) + ins + string(runes[pos+del:])
+	}
+	for _, cur := range []string{
+		doc,
+		"",
+		edit(0, 0, "Начало. "),             // Insert at the start
+		edit(len(runes), 0, " Конец."),     // Insert at the end
+		edit(100, 0, "вставка 🔥"),          // Insert in the middle
+		edit(0, 10, ""),                    // Delete at the start
+		edit(len(runes)-10, 10, ""),        // Delete at the end
+		edit(200, 50, ""),                  // Delete in the middle
+		edit(150, 1, "Ё"),                  // Replace a single character
+		edit(150, 1, "ё"),                  // Replace with a character sharing UTF-8 lead byte
+		edit(50, 20, "日本語"),                // Replace with another script
+		strings.Replace(doc, "а", "a", -1), // Many changes
+	} {
+		delta := EncodeDelta(doc, cur)
+		if ctrl, err := DecodeDelta(doc, delta); err != nil || ctrl != cur {
+			t.Errorf("Delta %v decoded as '%v' (%v), expected '%v'", hexString(delta), ctrl, err, cur)
+		}
+		if cur == doc && len(delta) > 4 {
+			t.Errorf("Delta of equal strings takes %v bytes", len(delta))
+		}
+	}
+	if delta := EncodeDelta(doc, edit(150, 1, "Ё")); len(delta) > 8 {
+		t.Errorf("Delta for a single replaced character takes %v bytes", len(delta))
+	}
+	// Overlapping prefix and suffix
+	for _, test := range [][2]string{{"aaa", "aaaa"}, {"aaaa", "aaa"}, {"abab", "ab"}, {"", "abc"}, {"abc", ""}, {"Жж", "Жжж"}, {"ЖЖ", "ЖЁЖ"}} {
+		if ctrl, err := DecodeDelta(test[0], EncodeDelta(test[0], test[1])); err != nil || ctrl != test[1] {
+			t.Errorf("Delta from '%v' to '%v' decoded as '%v' (%v)", test[0], test[1], ctrl, err)
+		}
+	}
+
+	if _, err := DecodeDelta("abc", EncodeDelta("abcdef", "abcdef!")); err != ErrDeltaMismatch {
+		t.Errorf("Expected ErrDeltaMismatch, got %v", err)
+	}
+	if _, err := DecodeDelta("abc", []byte{0x01}); !errors.Is(err, ErrTruncated) {
+		t.Errorf("Expected ErrTruncated, got %v", err)
+	}
+	if _, err := DecodeDelta("abc", []byte{0x01, 0x01, 0x84}); !errors.Is(err, ErrTruncated) {
+		t.Errorf("Expected ErrTruncated, got %v", err)
+	}
+}
@@ -0,0 +1,154 @@
+package utfc
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"io"
+)
+
+// Frames are UTF-C records prefixed with their length in bytes as an unsigned varint (see encoding/binary).
+// Each record is encoded independently, starting from the initial state.
+
+// AppendFrame appends a length-prefixed UTF-C record for str to dst and returns the extended buffer
+func AppendFrame(dst []byte, str string) []byte {
+	var prefix [binary.MaxVarintLen64]byte
+	buf := Encode(str)
+	dst = append(dst, prefix[:binary.PutUvarint(prefix[:], uint64(len(buf)))]...)
+	return append(dst, buf...)
+}
+
+// DecodeFrames decodes all consecutive length-prefixed records in buf.
+// If a record (or its length) is truncated or malformed, it returns a *DecodeError with an offset in buf;
+// the strings decoded before it are returned as well.
+func DecodeFrames(buf []byte) ([]string, error) {
+	var strs []string
+	for i := 0; i < len(buf); {
+		size, n := binary.Uvarint(buf[i:])
+		if n == 0 || (n > 0 && uint64(len(buf)-i-n) < size) {
+			return strs, &DecodeError{Offset: i, Err: ErrTruncated}
+		}
+		if n < 0 {
+			return strs, &DecodeError{Offset: i, Err: ErrInvalid}
+		}
+		start := i + n
+		str, err := DecodeSafe(buf[start : start+int(size)])
+		if err != nil {
+			var decodeErr *DecodeError
+			if errors.As(err, &decodeErr) {
+				return strs, &DecodeError{Offset: start + decodeErr.Offset, Err: decodeErr.Err}
+			}
+			return strs, err
+		}
+		strs = append(strs, str)
+		i = start + int(size)
+	}
+	return strs, nil
+}
+
+// Segments allow mixing UTF-C text with raw binary data in one stream. Each segment is prefixed with an unsigned varint
+// holding its length in bytes shifted left by one, with the lowest bit set for raw segments.
+// Text segments are encoded independently, starting from the initial state.
+
+// SegmentWriter writes text and raw segments to an underlying writer
+type SegmentWriter struct {
+	w   io.Writer
+	buf []byte
+}
+
+// NewSegmentWriter returns a new SegmentWriter writing to w
+func NewSegmentWriter(w io.Writer) *SegmentWriter {
+	return &SegmentWriter{w: w}
+}
+
+// WriteText writes a segment containing UTF-C encoding of str
+func (sw *SegmentWriter) WriteText(str string) error {
+	return sw.write(Encode(str), 0)
+}
+
+// WriteRaw writes a segment containing p as is
+func (sw *SegmentWriter) WriteRaw(p []byte) error {
+	return sw.write(p, 1)
+}
+
+func (sw *SegmentWriter) write(p []byte, kind uint64) error {
+	var prefix [binary.MaxVarintLen64]byte
+	buf := append(sw.buf[:0], prefix[:binary.PutUvarint(prefix[:], uint64(len(p))<<1|kind)]...)
+	sw.buf = append(buf, p...)
+	_, err := sw.w.Write(sw.buf)
+	return err
+}
+
+// Segment is a single segment read by SegmentReader
+type Segment struct {
+	Raw  bool   // Whether the segment was written by WriteRaw
+	Text string // Decoded text of a text segment
+	Data []byte // Content of a raw segment
+}
+
+// SegmentReader reads segments written by SegmentWriter
+type SegmentReader struct {
+	r    *bufio.Reader
+	offs int // Offset of the next segment in the stream
+}
+
+// NewSegmentReader returns a new SegmentReader reading from r
+func NewSegmentReader(r io.Reader) *SegmentReader {
+	return &SegmentReader{r: bufio.NewReader(r)}
+}
+
+// Next reads the next segment. It returns io.EOF if there are no more segments.
+// If a segment is truncated or malformed, it returns a *DecodeError with an offset in the stream.
+func (sr *SegmentReader) Next() (Segment, error) {
+	cr := &countingReader{r: sr.r}
+	header, err := binary.ReadUvarint(cr)
+	if cr.err == io.EOF && cr.n == 0 {
+		return Segment{}, io.EOF
+	} else if cr.err == io.EOF {
+		return Segment{}, &DecodeError{Offset: sr.offs, Err: ErrTruncated}
+	} else if cr.err != nil {
+		return Segment{}, cr.err
+	} else if err != nil {
+		return Segment{}, &DecodeError{Offset: sr.offs, Err: ErrInvalid} // Varint overflow
+	}
+	start := sr.offs + cr.n
+	// The buffer grows as the data arrives, so a corrupted length doesn't allocate it all at once
+	var content bytes.Buffer
+	if _, err := io.CopyN(&content, sr.r, int64(header>>1)); err == io.EOF {
+		return Segment{}, &DecodeError{Offset: sr.offs, Err: ErrTruncated}
+	} else if err != nil {
+		return Segment{}, err
+	}
+	data := content.Bytes()
+	sr.offs = start + len(data)
+	if header&1 == 1 {
+		return Segment{Raw: true, Data: data}, nil
+	}
+	str, err := DecodeSafe(data)
+	if err != nil {
+		var decodeErr *DecodeError
+		if errors.As(err, &decodeErr) {
+			return Segment{}, &DecodeError{Offset: start + decodeErr.Offset, Err: decodeErr.Err}
+		}
+		return Segment{}, err
+	}
+	return Segment{Text: str}, nil
+}
+
+// countingReader counts bytes read by binary.ReadUvarint and remembers the error of the underlying reader
+type countingReader struct {
+	r   io.ByteReader
+	n   int
+	err error
+}
+
+func (cr *countingReader) ReadByte() (byte, error) {
+	b, err := cr.r.ReadByte()
+	if err != nil {
+		cr.err = err
+		return b, err
+	}
+	cr.n++
+	return b, nil
+}
@@ -0,0 +1,106 @@
+package utfc
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"testing"
+)
+
+func TestDecodeFrames(t *testing.T) {
+	strs := append([]string{"", "Привет", ""}, testStrings...)
+	var buf []byte
+	for _, str := range strs {
+		buf = AppendFrame(buf, str)
+	}
+	if decoded, err := DecodeFrames(buf); err != nil || fmt.Sprintf("%q", decoded) != fmt.Sprintf("%q", strs) {
+		t.Errorf("Frames decoded as %q (%v)", decoded, err)
+	}
+	if decoded, err := DecodeFrames(nil); err != nil || len(decoded) != 0 {
+		t.Errorf("Empty buffer decoded as %q (%v)", decoded, err)
+	}
+
+	buf = AppendFrame(AppendFrame(nil, "ab"), "Мир") // 02 61 62 04 84 1C 38 40
+	for _, test := range []struct {
+		buf    []byte
+		strs   int
+		offset int
+		err    error
+	}{
+		{buf[:len(buf)-1], 1, 3, ErrTruncated},
+		{buf[:4], 1, 3, ErrTruncated},
+		{append(buf[:3:3], 0x80), 1, 3, ErrTruncated},       // Varint length itself is truncated
+		{append(buf[:3:3], 0x01, 0x84), 1, 4, ErrTruncated}, // Record is complete, but its content is not
+		{append(buf[:3:3], 0x02, 0xBF, 0xFF), 1, 4, ErrInvalid},
+		{append(buf[:3:3], 0xFF, 0xFF, 0xFF, 0xFF, 0xFF, 0xFF, 0xFF, 0xFF, 0xFF, 0xFF, 0x01), 1, 3, ErrInvalid},
+	} {
+		decoded, err := DecodeFrames(test.buf)
+		var decodeErr *DecodeError
+		if !errors.As(err, &decodeErr) || decodeErr.Err != test.err || decodeErr.Offset != test.offset || len(decoded) != test.strs {
+			t.Errorf("Bytes %v decoded as %q (%v), expected %v strings and %v at offset %v", hexString(test.buf), decoded, err, test.strs, test.err, test.offset)
+		}
+	}
+}
+
+func TestSegments(t *testing.T) {
+	// Raw segments contain bytes that would be markers (or invalid) in UTF-C
+	segments := []Segment{
+		{Text: "Привет"},
+		{Raw: true, Data: []byte{0xBF, 0xFF, 0x80}},
+		{Text: ""},
+		{Raw: true, Data: []byte{}},
+		{Text: "日本語 🔥"},
+		{Raw: true, Data: bytes.Repeat([]byte{0xA0}, 300)},
+		{Text: "ab"},
+	}
+	var stream bytes.Buffer
+	sw := NewSegmentWriter(&stream)
+	for _, seg := range segments {
+		var err error
+		if seg.Raw {
+			err = sw.WriteRaw(seg.Data)
+		} else {
+			err = sw.WriteText(seg.Text)
+		}
+		if err != nil {
+			t.Fatalf("Write failed: %v", err)
+		}
+	}
+	buf := stream.Bytes()
+	sr := NewSegmentReader(bytes.NewReader(buf))
+	for i, expected := range segments {
+		seg, err := sr.Next()
+		if err != nil || seg.Raw != expected.Raw || seg.Text != expected.Text || !bytes.Equal(seg.Data, expected.Data) {
+			t.Errorf("Segment %d read as %+v (%v), expected %+v", i, seg, err, expected)
+		}
+	}
+	if seg, err := sr.Next(); err != io.EOF {
+		t.Errorf("Expected io.EOF after the last segment, got %+v (%v)", seg, err)
+	}
+
+	// The last segment is "ab" (04 61 62), preceded by a raw one of 300 bytes
+	last := len(buf) - 3
+	for _, test := range []struct {
+		buf    []byte
+		offset int
+		err    error
+	}{
+		{buf[:len(buf)-1], last, ErrTruncated},
+		{buf[:last-1], last - 302, ErrTruncated}, // Inside the raw segment
+		{append(buf[:last:last], 0x80), last, ErrTruncated},
+		{append(buf[:last:last], 0x04, 0x61, 0xBF), last + 2, ErrTruncated},
+		{append(buf[:last:last], 0x04, 0xBF, 0xFF), last + 1, ErrInvalid},
+		{append(buf[:last:last], 0xFF, 0xFF, 0xFF, 0xFF, 0xFF, 0xFF, 0xFF, 0xFF, 0xFF, 0xFF, 0x01), last, ErrInvalid},
+	} {
+		sr := NewSegmentReader(bytes.NewReader(test.buf))
+		var err error
+		for err == nil {
+			_, err = sr.Next()
+		}
+		var decodeErr *DecodeError
+		if !errors.As(err, &decodeErr) || decodeErr.Err != test.err || decodeErr.Offset != test.offset {
+			t.Errorf("Bytes ending with %v read with %v, expected %v at offset %v", hexString(test.buf[last-1:]), err, test.err, test.offset)
+		}
+	}
+}
@@ -0,0 +1,55 @@
+// Package grpc provides a gRPC codec transferring string messages encoded with UTF-C.
+//
+// The codec implements the encoding.Codec interface of google.golang.org/grpc without importing it,
+// so this package doesn't add gRPC to the dependencies. To use it, import it under another name
+// (e.g. utfcgrpc "github.com/denull/utf-c/go/grpc"), register the codec and select it for calls:
+//
+//	encoding.RegisterCodec(utfcgrpc.Codec{})
+//	conn.Invoke(ctx, method, "Привет", &reply, grpc.CallContentSubtype(utfcgrpc.Name))
+package grpc
+
+import (
+	"fmt"
+
+	utfc "github.com/denull/utf-c/go"
+)
+
+// Name is the name of the codec, used as the content subtype ("application/grpc+utfc")
+const Name = "utfc"
+
+// Codec marshals string messages (string or *string values) via utfc.Encode and unmarshals them into *string
+// via utfc.DecodeSafe. Other types of messages are rejected.
+type Codec struct{}
+
+// Marshal returns UTF-C encoding of v, which must be a string or a *string
+func (Codec) Marshal(v interface{}) ([]byte, error) {
+	switch msg := v.(type) {
+	case string:
+		return utfc.Encode(msg), nil
+	case *string:
+		if msg == nil {
+			return nil, fmt.Errorf("utfc/grpc: cannot marshal nil *string")
+		}
+		return utfc.Encode(*msg), nil
+	}
+	return nil, fmt.Errorf("utfc/grpc: cannot marshal %T, expected string", v)
+}
+
+// Unmarshal decodes UTF-C data into v, which must be a *string. It returns a *utfc.DecodeError if data is malformed.
+func (Codec) Unmarshal(data []byte, v interface{}) error {
+	msg, ok := v.(*string)
+	if !ok || msg == nil {
+		return fmt.Errorf("utfc/grpc: cannot unmarshal into %T, expected *string", v)
+	}
+	str, err := utfc.DecodeSafe(data)
+	if err != nil {
+		return err
+	}
+	*msg = str
+	return nil
+}
+
+// Name returns the name of the codec
+func (Codec) Name() string {
+	return Name
+}
@@ -0,0 +1,52 @@
+package grpc
+
+import (
+	"errors"
+	"testing"
+
+	utfc "github.com/denull/utf-c/go"
+)
+
+// codec is the encoding.Codec interface of google.golang.org/grpc
+type codec interface {
+	Marshal(v interface{}) ([]byte, error)
+	Unmarshal(data []byte, v interface{}) error
+	Name() string
+}
+
+func TestCodec(t *testing.T) {
+	var c codec = Codec{}
+	if c.Name() != "utfc" {
+		t.Errorf("Unexpected codec name %v", c.Name())
+	}
+	for _, str := range []string{"", "Hello World!", "Привет, мир!", "日本語 ひらがな 🔥"} {
+		data, err := c.Marshal(str)
+		if err != nil || string(data) != string(utfc.Encode(str)) {
+			t.Errorf("String '%v' marshaled as %v (%v)", str, data, err)
+		}
+		if ptrData, err := c.Marshal(&str); err != nil || string(ptrData) != string(data) {
+			t.Errorf("Pointer to '%v' marshaled as %v (%v)", str, ptrData, err)
+		}
+		var ctrl string
+		if err := c.Unmarshal(data, &ctrl); err != nil || ctrl != str {
+			t.Errorf("String '%v' unmarshaled as '%v' (%v)", str, ctrl, err)
+		}
+	}
+
+	var nilStr *string
+	for _, v := range []interface{}{42, []byte("abc"), nil, nilStr} {
+		if _, err := c.Marshal(v); err == nil {
+			t.Errorf("Expected an error when marshaling %T", v)
+		}
+	}
+	ctrl := "unchanged"
+	for _, v := range []interface{}{ctrl, new([]byte), nil, nilStr} {
+		if err := c.Unmarshal([]byte("abc"), v); err == nil {
+			t.Errorf("Expected an error when unmarshaling into %T", v)
+		}
+	}
+	var decodeErr *utfc.DecodeError
+	if err := c.Unmarshal([]byte{'a', 0xBF, 0xFF}, &ctrl); !errors.As(err, &decodeErr) || ctrl != "unchanged" {
+		t.Errorf("Expected a DecodeError for malformed data, got %v ('%v')", err, ctrl)
+	}
+}
@@ -0,0 +1,273 @@
+package utfc
+
+import (
+	"errors"
+	"unicode/utf8"
+)
+
+// ErrInvalidPrivateWindow is returned by EncodeWith and DecodeWith if Options.PrivateWindow is not a valid window
+var ErrInvalidPrivateWindow = errors.New("utfc: invalid private window")
+
+// ErrInvalidAuxOffsets is returned by EncodeWith and DecodeWith if Options.AuxOffsets has an invalid entry
+var ErrInvalidAuxOffsets = errors.New("utfc: invalid auxiliary alphabet offsets")
+
+// ErrInvalidLatinAux is returned by EncodeWith and DecodeWith if Options.LatinAux is not a valid set of ranges
+var ErrInvalidLatinAux = errors.New("utfc: invalid Latin auxiliary alphabet")
+
+// ErrInvalidRestartInterval is returned by EncodeWith and DecodeWith if Options.RestartInterval is negative
+var ErrInvalidRestartInterval = errors.New("utfc: invalid restart interval")
+
+// ErrRestartsEscaped is returned by EncodeWithRestarts if Options.EscapeNewlines is set,
+// since decoding can't start in the middle of stuffed data
+var ErrRestartsEscaped = errors.New("utfc: restart points are not available with escaped newlines")
+
+// ErrInvalidUTF8 is returned by EncodeWith for invalid UTF-8 input when OnInvalidUTF8 is set to ErrorOnInvalid
+var ErrInvalidUTF8 = errors.New("utfc: invalid UTF-8")
+
+// InvalidUTF8Mode defines how invalid UTF-8 sequences in the input are handled
+type InvalidUTF8Mode int
+
+const (
+	ReplaceInvalid InvalidUTF8Mode = iota // Replace each invalid byte with U+FFFD (the same way `range` over a string does)
+	ErrorOnInvalid                        // Stop encoding and return ErrInvalidUTF8
+	SkipInvalid                           // Drop invalid bytes
+)
+
+// Options allows tweaking the encoding.
+// Unless stated otherwise, the output produced with any options can be decoded with the standard Decode.
+type Options struct {
+	// SimpleAstral disables 2-byte encoding of Hiragana, Katakana and emojis, so those characters
+	// are always encoded as regular 21-bit ones (taking 3 bytes for the first character in the window, 2 for the rest).
+	// It's intended for minimal decoders that don't want to handle remapped extra ranges.
+	// Characters in U+2000-U+27FF have no other representation and are still encoded via the first extra range,
+	// which is mapped linearly: 0xB1-0xB8 followed by the lowest byte of (codepoint - 0x2000).
+	SimpleAstral bool
+
+	// AuxOffsets overrides the start of the auxiliary alphabet selected after leaving a given 13-bit alphabet.
+	// Keys are alphabet offsets (multiples of 0x80), values are the first codepoints of 64-character windows.
+	// Alphabets not listed here use the built-in table. Data encoded with custom AuxOffsets
+	// must be decoded via DecodeWith with the same options.
+	AuxOffsets map[int]int
+
+	// MinimizeSwitches makes the encoder avoid switches that aren't required. By default Hiragana and Katakana
+	// are encoded via extra ranges, which switches to their 13-bit alphabet even if they are in the current 21-bit one
+	// (U+2800-U+A7FF, which also includes CJK ideographs). With this option they're encoded as characters
+	// of the current 21-bit alphabet instead: it takes 2 bytes either way, but the following kana take 2 bytes
+	// instead of 1, while returning to ideographs doesn't require a 3-byte switch. So it's shorter only for text
+	// where single kana alternate with ideographs; typical Japanese text becomes a few percent longer.
+	// The output can be decoded with the standard Decode.
+	// It's the only case where a switch can be avoided: all other switches are required by the format.
+	MinimizeSwitches bool
+
+	// DenseEmoji makes emojis from extra ranges (U+1F170 and above) switch the current alphabet, like Hiragana and Katakana do.
+	// Then each following emoji from the same 128-codepoint window takes 1 byte instead of 2.
+	// Data encoded with DenseEmoji must be decoded via DecodeWith with the same option.
+	DenseEmoji bool
+
+	// PrivateWindow is the first codepoint of a 64-character window (a multiple of 0x40, from U+2800 and outside of extra ranges)
+	// that can be switched to with 2 bytes: 0xBF 0xC0-0xBF 0xFF, codes not used by extra ranges. After the switch
+	// the 128-codepoint alphabet containing the window is the current one, so its characters take 1 byte.
+	// It's intended for private use characters, which otherwise need 3-byte 21-bit switches and 2 bytes per character.
+	// Data encoded with PrivateWindow must be decoded via DecodeWith with the same option.
+	PrivateWindow int
+
+	// LatinAux replaces the set of characters available via the auxiliary alphabet when it's Latin
+	// (by default, A-Z, a-z, 0-9, space and "-"). It's a list of half-open ranges [first, last+1) of codepoints,
+	// which are numbered consecutively, so they must not overlap and must contain at most 64 codepoints in total.
+	// Data encoded with custom LatinAux must be decoded via DecodeWith with the same option.
+	LatinAux [][]int
+
+	// RestartInterval, if positive, resets the state to the initial one after every RestartInterval characters,
+	// so the next character switches to its alphabet from scratch. It adds a few bytes per restart point.
+	// Restart points are not marked in the output, so a decoder can't find them on its own: their offsets are returned
+	// by EncodeWithRestarts and have to be stored separately (e.g. in an index). Decoding via DecodeWith from such
+	// an offset (e.g. after joining a stream midway) gives the rest of the text.
+	// Data encoded with RestartInterval must be decoded via DecodeWith with the same option.
+	RestartInterval int
+
+	// EscapeNewlines guarantees there are no 0x0A bytes in the output, so it can be processed by line-based tools.
+	// Not only U+000A produces this byte: so does any character at offset 0x0A in the current alphabet (like "Њ"
+	// in Cyrillic text) and many lower bytes of longer sequences. So the encoded data is stuffed with COBS
+	// (the same way EncodeCString does, but eliminating 0x0A instead of 0x00), which adds a byte per every 254 bytes
+	// (rounded up). Data encoded with EscapeNewlines must be decoded via DecodeWith with the same option;
+	// offsets in DecodeError then refer to the data after unstuffing, unless the stuffing itself is invalid.
+	EscapeNewlines bool
+
+	// OnInvalidUTF8 selects what to do with invalid UTF-8 in the input (ReplaceInvalid by default).
+	// Only malformed bytes are treated as invalid: U+FFFD present in the input as a proper 3-byte sequence
+	// is a regular character and is always encoded, even with ErrorOnInvalid or SkipInvalid.
+	OnInvalidUTF8 InvalidUTF8Mode
+}
+
+func (opts Options) auxOffset(offs int) int {
+	if remappedOffs, ok := opts.AuxOffsets[offs]; ok {
+		return remappedOffs
+	}
+	return getAuxOffset(offs)
+}
+
+// latinAux returns the ranges of the Latin auxiliary alphabet
+func (opts Options) latinAux() [][]int {
+	if opts.LatinAux != nil {
+		return opts.LatinAux
+	}
+	return rangesLatin
+}
+
+// switchesOnExtra reports whether encoding cp from extra ranges changes the current alphabet
+func (opts Options) switchesOnExtra(cp int) bool {
+	if cp >= rangeHK[0] && cp < rangeHK[1] {
+		return true
+	}
+	return opts.DenseEmoji && cp >= rangesExtra[3][0]
+}
+
+// Validate checks that the options are consistent: AuxOffsets keys are alphabet offsets and their windows lie within
+// the alphabet (U+0000-U+02FF for Latin) or are 0 for Latin, LatinAux ranges don't overlap and fit 64 characters,
+// PrivateWindow is usable, and RestartInterval is not negative.
+// EncodeWith and DecodeWith call it themselves, but it can be used to check the configuration upfront.
+func (opts Options) Validate() error {
+	for offs, window := range opts.AuxOffsets {
+		inBlock := window >= offs && window+0x40 <= offs+0x80
+		if offs == 0 { // Latin alphabet is used for all codepoints up to maxLatinCp
+			inBlock = window >= 0 && window+0x40 <= maxLatinCp+1
+		}
+		if offs < 0 || offs%0x80 != 0 || offs > utf8.MaxRune || (window != 0 && !inBlock) {
+			return ErrInvalidAuxOffsets
+		}
+	}
+	if opts.LatinAux != nil {
+		total := 0
+		for i, rng := range opts.LatinAux {
+			if len(rng) != 2 || rng[0] < 0 || rng[0] >= rng[1] || rng[1] > utf8.MaxRune+1 {
+				return ErrInvalidLatinAux
+			}
+			for _, other := range opts.LatinAux[:i] {
+				if rng[0] < other[1] && other[0] < rng[1] {
+					return ErrInvalidLatinAux
+				}
+			}
+			total += rng[1] - rng[0]
+		}
+		if total > 0x40 {
+			return ErrInvalidLatinAux
+		}
+	}
+	if opts.RestartInterval < 0 {
+		return ErrInvalidRestartInterval
+	}
+	if pw := opts.PrivateWindow; pw != 0 {
+		if pw%0x40 != 0 || pw < min21BitCp || pw+0x40 > utf8.MaxRune+1 || inRanges(pw, rangesExtra) || inRanges(pw+0x3F, rangesExtra) {
+			return ErrInvalidPrivateWindow
+		}
+	}
+	return nil
+}
+
+// EncodeWith converts string to an UTF-C byte array using the given options
+func EncodeWith(str string, opts Options) ([]byte, error) {
+	if err := opts.Validate(); err != nil {
+		return nil, err
+	}
+	buf, err := encodeWith(make([]byte, 0, len(str)), initState(), str, &opts, nil)
+	if err == nil && opts.EscapeNewlines {
+		buf = stuffBytes(make([]byte, 0, len(buf)+len(buf)/(maxStuffedBlock-1)+1), buf, '\n')
+	}
+	return buf, err
+}
+
+// EncodeWithRestarts works like EncodeWith, and also returns the offsets in buf of restart points
+// (see Options.RestartInterval), from which the data can be decoded with DecodeWith.
+// It returns ErrRestartsEscaped if opts.EscapeNewlines is set.
+func EncodeWithRestarts(str string, opts Options) (buf []byte, restarts []int, err error) {
+	if err := opts.Validate(); err != nil {
+		return nil, nil, err
+	}
+	if opts.EscapeNewlines {
+		return nil, nil, ErrRestartsEscaped
+	}
+	buf, err = encodeWith(make([]byte, 0, len(str)), initState(), str, &opts, &restarts)
+	if err != nil {
+		return nil, nil, err
+	}
+	return buf, restarts, nil
+}
+
+// encodeWith appends the encoding of str to buf starting from the state st.
+// If restarts is not nil, offsets of restart points are appended to it.
+func encodeWith(buf []byte, st state, str string, opts *Options, restarts *[]int) ([]byte, error) {
+	runes := 0
+	for i, ch := range str {
+		if ch == utf8.RuneError && opts.OnInvalidUTF8 != ReplaceInvalid {
+			// U+FFFD can be present in the input itself, so check whether it came from a 1-byte invalid sequence
+			if _, size := utf8.DecodeRuneInString(str[i:]); size == 1 {
+				if opts.OnInvalidUTF8 == ErrorOnInvalid {
+					return nil, ErrInvalidUTF8
+				}
+				continue
+			}
+		}
+		if opts.RestartInterval > 0 && runes > 0 && runes%opts.RestartInterval == 0 {
+			st = initState()
+			if restarts != nil {
+				*restarts = append(*restarts, len(buf))
+			}
+		}
+		buf = st.encodeRune(buf, int(ch), opts)
+		runes++
+	}
+	return buf, nil
+}
+
+// DecodeWith converts UTF-C byte array to a string using the given options, returning a *DecodeError if the buffer is malformed.
+// In that case the string holds the text decoded before the error offset.
+func DecodeWith(buf []byte, opts Options) (string, error) {
+	if err := opts.Validate(); err != nil {
+		return "", err
+	}
+	out := make([]byte, 0, len(buf))
+	err := decodeEach(buf, currentFormat, &opts, func(cp int) {
+		out = appendRune(out, cp)
+	})
+	return string(out), err
+}
+
+// decodeEach decodes buf in the format version v with valid options, calling fn for each character.
+// It returns a *DecodeError if buf is malformed, after calling fn for all preceding characters.
+func decodeEach(buf []byte, v FormatVersion, opts *Options, fn func(cp int)) error {
+	if opts.EscapeNewlines {
+		var err error
+		if buf, err = unstuffBytes(buf, '\n'); err != nil {
+			return err
+		}
+	}
+	st := initStateOf(v)
+	i, runes := 0, 0
+	for i < len(buf) {
+		if opts.RestartInterval > 0 && runes > 0 && runes%opts.RestartInterval == 0 {
+			st = initStateOf(v)
+		}
+		cp, n, err := st.decodeRuneOf(v, buf, i, opts)
+		if err == nil && !utf8.ValidRune(rune(cp)) {
+			err = ErrInvalid
+		}
+		if err != nil {
+			return &DecodeError{Offset: i, Err: err}
+		}
+		assertAdvance(i, n, len(buf))
+		i += n
+		runes++
+		fn(cp)
+	}
+	return nil
+}
+
+// Reencode converts data encoded with options `from` to the encoding with options `to`.
+// It returns a *DecodeError if buf is malformed under `from`.
+func Reencode(buf []byte, from, to Options) ([]byte, error) {
+	str, err := DecodeWith(buf, from)
+	if err != nil {
+		return nil, err
+	}
+	return EncodeWith(str, to)
+}
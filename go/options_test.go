@@ -0,0 +1,413 @@
+package utfc
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"strings"
+	"testing"
+)
+
+func TestSimpleAstral(t *testing.T) {
+	opts := Options{SimpleAstral: true}
+	for _, test := range testStrings {
+		buf, _ := EncodeWith(test, opts)
+		if ctrl := Decode(buf); ctrl != test {
+			t.Errorf("String '%v' decoded back as '%v', bytes: %v", test, ctrl, hexString(buf))
+		}
+	}
+
+	// Emojis and Hiragana use 21-bit encoding, but U+2000-U+27FF still go to the first extra range
+	for _, test := range []struct {
+		str string
+		buf []byte
+	}{
+		{"🔥🔥", []byte{0xA1, 0xCD, 0x25, 0x4D, 0x25}},
+		{"か", []byte{0xA0, 0x08, 0x4B}},
+		{"₠", []byte{0xB1, 0xA0}},
+	} {
+		if buf, _ := EncodeWith(test.str, opts); !bytes.Equal(buf, test.buf) {
+			t.Errorf("String '%v' encoded as %v, expected %v", test.str, hexString(buf), hexString(test.buf))
+		}
+	}
+}
+
+func TestAuxOffsets(t *testing.T) {
+	// Armenian lowercase letters start at U+0561, so by default they don't fit into the auxiliary alphabet
+	str := "Բարեւ, աշխարհ, Բարեւ, աշխարհ"
+	opts := Options{AuxOffsets: map[int]int{0x0500: SuggestAuxOffset(str, 0x0500)}}
+	buf, _ := EncodeWith(str, opts)
+	if ctrl, err := DecodeWith(buf, opts); err != nil || ctrl != str {
+		t.Errorf("String '%v' decoded back as '%v' (%v), bytes: %v", str, ctrl, err, hexString(buf))
+	}
+	if len(buf) >= len(Encode(str)) {
+		t.Errorf("Custom auxiliary alphabet did not reduce size: %v vs %v", len(buf), len(Encode(str)))
+	}
+}
+
+func TestSuggestAuxOffset(t *testing.T) {
+	for _, test := range []struct {
+		str   string
+		block int
+		offs  int
+	}{
+		{"", 0x0400, 0x0400},
+		{"abc", 0x0400, 0x0400},
+		{"Словарь", 0x0400, 0x040D},
+		{"ЀЀЀ", 0x0400, 0x0400},
+		{"ҁҁҁ", 0x0480, 0x0480},
+		{"ӿӿӿ", 0x0480, 0x04C0},
+		{"աշխարհ", 0x0500, 0x0538},
+		{"աշխարհ", 0x0561, 0x0538},
+	} {
+		if offs := SuggestAuxOffset(test.str, test.block); offs != test.offs {
+			t.Errorf("Suggested offset for '%v' in 0x%04X is 0x%04X, expected 0x%04X", test.str, test.block, offs, test.offs)
+		}
+	}
+}
+
+func TestOnInvalidUTF8(t *testing.T) {
+	str := "ab\x80cd"
+	for _, test := range []struct {
+		mode InvalidUTF8Mode
+		str  string
+		err  error
+	}{
+		{ReplaceInvalid, "ab\uFFFDcd", nil},
+		{ErrorOnInvalid, "", ErrInvalidUTF8},
+		{SkipInvalid, "abcd", nil},
+	} {
+		buf, err := EncodeWith(str, Options{OnInvalidUTF8: test.mode})
+		if err != test.err {
+			t.Errorf("Mode %v returned error %v, expected %v", test.mode, err, test.err)
+		}
+		if err == nil && Decode(buf) != test.str {
+			t.Errorf("Mode %v produced '%v', expected '%v'", test.mode, Decode(buf), test.str)
+		}
+	}
+
+	// Genuine U+FFFD is a valid character and is never treated as invalid input
+	str = "ab\uFFFDcd\uFFFD"
+	for _, mode := range []InvalidUTF8Mode{ReplaceInvalid, ErrorOnInvalid, SkipInvalid} {
+		buf, err := EncodeWith(str, Options{OnInvalidUTF8: mode})
+		if err != nil {
+			t.Errorf("Mode %v returned error %v for genuine U+FFFD", mode, err)
+		}
+		if ctrl, err := DecodeSafe(buf); err != nil || ctrl != str {
+			t.Errorf("Mode %v: string '%v' decoded back as '%v' (%v)", mode, str, ctrl, err)
+		}
+	}
+	// Both kinds are encoded identically in the default mode, so only strict modes can tell them apart
+	if !bytes.Equal(Encode("\uFFFD"), Encode("\x80")) {
+		t.Errorf("Invalid byte encoded as %v, expected %v", hexString(Encode("\x80")), hexString(Encode("\uFFFD")))
+	}
+	if _, err := EncodeWith("\uFFFD\x80", Options{OnInvalidUTF8: ErrorOnInvalid}); err != ErrInvalidUTF8 {
+		t.Errorf("Expected ErrInvalidUTF8 for invalid byte after genuine U+FFFD, got %v", err)
+	}
+}
+
+func TestHeaderSavings(t *testing.T) {
+	// A header byte selecting the initial base alphabet from a palette doesn't make strings shorter.
+	// Each of these states is exactly the state after switching to the alphabet from Latin, and such a switch
+	// costs only 1 byte more than encoding the character inline, so the header at best breaks even.
+	// Knowing the initial state out of band (without a header) is what saves bytes.
+	palette := []state{
+		initState(),
+		{offs: 0x0080, auxOffs: 0},
+		{offs: 0x0380, auxOffs: 0},
+		{offs: 0x0400, auxOffs: 0},
+		{offs: 0x0580, auxOffs: 0},
+		{offs: 0x0980, auxOffs: 0},
+		{offs: 0x0E00, auxOffs: 0},
+		{offs: 0x3000, auxOffs: 0},
+		{offs: 0x3080, auxOffs: 0},
+		{offs: 0x0000, auxOffs: 0, is21Bit: true},
+		{offs: 0x8000, auxOffs: 0, is21Bit: true},
+	}
+	labels := []string{"OK", "Ελλάδα", "Файл", "Zeitgeist·Россия", "שלום", "ভাষা", "ไทย", "ひらがな", "カタカナ", "中文", "한국어"}
+	for _, test := range append(labels, testStrings...) {
+		for _, st := range palette {
+			buf, _ := encodeWith(nil, st, test, &Options{}, nil)
+			if len(buf)+1 < len(Encode(test)) {
+				t.Errorf("Header with state %+v saves bytes for '%v'", st, test)
+			}
+		}
+	}
+	// But a header selecting the auxiliary alphabet too can save bytes for strings mixing two scripts
+	st := state{offs: 0x0380, auxOffs: 0x0410}
+	if buf, _ := encodeWith(nil, st, "ΑЖ", &Options{}, nil); len(buf)+1 != 3 || len(Encode("ΑЖ")) != 4 {
+		t.Errorf("'ΑЖ' takes %v bytes with a header and %v without", len(buf)+1, len(Encode("ΑЖ")))
+	}
+}
+
+var reactions = strings.Repeat("👍👍❤\uFE0F😂🔥👍😮😂😂🙏👏👍🎉😢🔥🔥👍😂 ", 50)
+
+func TestDenseEmoji(t *testing.T) {
+	opts := Options{DenseEmoji: true}
+	for _, test := range append(testStrings, reactions, "🔥🔥🔥", "Мир🔥мир🔥", "中🔥中", "🔥ひらがな🔥") {
+		buf, _ := EncodeWith(test, opts)
+		if ctrl, err := DecodeWith(buf, opts); err != nil || ctrl != test {
+			t.Errorf("String '%v' decoded back as '%v' (%v), bytes: %v", test, ctrl, err, hexString(buf))
+		}
+	}
+	for _, test := range []struct {
+		str string
+		buf []byte
+	}{
+		// The first emoji switches to U+1F500-U+1F57F, the following ones take 1 byte
+		{"🔥🔥🔥", []byte{0xBC, 0xC5, 0x25, 0x25}},
+		// Latin becomes auxiliary, so spaces between emojis are still 1 byte
+		{"🔥 🔥", []byte{0xBC, 0xC5, 0xFE, 0x25}},
+	} {
+		if buf, _ := EncodeWith(test.str, opts); !bytes.Equal(buf, test.buf) {
+			t.Errorf("String '%v' encoded as %v, expected %v", test.str, hexString(buf), hexString(test.buf))
+		}
+	}
+	if buf, _ := EncodeWith(reactions, opts); len(buf) >= len(Encode(reactions)) {
+		t.Errorf("DenseEmoji did not reduce size: %v vs %v", len(buf), len(Encode(reactions)))
+	}
+}
+
+func BenchmarkDenseEmoji(b *testing.B) {
+	for _, opts := range []Options{{}, {DenseEmoji: true}} {
+		b.Run(fmt.Sprintf("DenseEmoji=%v", opts.DenseEmoji), func(b *testing.B) {
+			b.SetBytes(int64(len(reactions)))
+			var buf []byte
+			for i := 0; i < b.N; i++ {
+				buf, _ = EncodeWith(reactions, opts)
+			}
+			b.ReportMetric(float64(len(buf))/float64(len(reactions)), "ratio")
+		})
+	}
+}
+
+func TestReencode(t *testing.T) {
+	// Two incompatible custom auxiliary alphabets for Armenian
+	str := "Բարեւ, աշխարհ, Բարեւ, աշխարհ"
+	from := Options{AuxOffsets: map[int]int{0x0500: 0x0531}}
+	to := Options{AuxOffsets: map[int]int{0x0500: 0x0540}}
+	buf, _ := EncodeWith(str, from)
+	if ctrl, _ := DecodeWith(buf, to); ctrl == str {
+		t.Fatalf("Configurations are expected to be incompatible")
+	}
+	migrated, err := Reencode(buf, from, to)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ctrl, err := DecodeWith(migrated, to); err != nil || ctrl != str {
+		t.Errorf("String '%v' migrated as '%v' (%v)", str, ctrl, err)
+	}
+	if back, err := Reencode(migrated, to, Options{}); err != nil || !bytes.Equal(back, Encode(str)) {
+		t.Errorf("Migration to the default options produced %v (%v), expected %v", hexString(back), err, hexString(Encode(str)))
+	}
+
+	for _, test := range testStrings {
+		if buf, err := Reencode(Encode(test), Options{}, Options{DenseEmoji: true}); err != nil {
+			t.Errorf("String '%v' was not reencoded: %v", test, err)
+		} else if ctrl, _ := DecodeWith(buf, Options{DenseEmoji: true}); ctrl != test {
+			t.Errorf("String '%v' reencoded as '%v'", test, ctrl)
+		}
+	}
+	if _, err := Reencode([]byte{0x84}, Options{}, Options{}); err == nil {
+		t.Errorf("Expected an error for malformed input")
+	}
+}
+
+func TestPrivateWindow(t *testing.T) {
+	opts := Options{PrivateWindow: 0xE000}
+	str := "\uE000\uE001\uE03F\uE07F Мир \uE000 中\uE010"
+	for _, test := range append(testStrings, str, "\uE040\uE000", "abc\uE000abc") {
+		buf, err := EncodeWith(test, opts)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if ctrl, err := DecodeWith(buf, opts); err != nil || ctrl != test {
+			t.Errorf("String %+q decoded back as %+q (%v), bytes: %v", test, ctrl, err, hexString(buf))
+		}
+	}
+	for _, test := range []struct {
+		str string
+		buf []byte
+	}{
+		// The switch takes 2 bytes, then the whole U+E000-U+E07F alphabet is 1 byte per character
+		{"\uE000\uE001\uE07F", []byte{0xBF, 0xC0, 0x01, 0x7F}},
+		// Characters of the second half of the alphabet can't be switched to directly
+		{"\uE040", []byte{0xA0, 0xB8, 0x40}},
+		// Latin becomes auxiliary after the switch
+		{"\uE000 a", []byte{0xBF, 0xC0, 0xFE, 0xDA}},
+	} {
+		if buf, _ := EncodeWith(test.str, opts); !bytes.Equal(buf, test.buf) {
+			t.Errorf("String %+q encoded as %v, expected %v", test.str, hexString(buf), hexString(test.buf))
+		}
+	}
+	if buf, _ := EncodeWith(str, opts); len(buf) >= len(Encode(str)) {
+		t.Errorf("PrivateWindow did not reduce size: %v vs %v", len(buf), len(Encode(str)))
+	}
+	// Without the option these codes are invalid
+	if _, err := DecodeSafe([]byte{0xBF, 0xC0}); !errors.Is(err, ErrInvalid) {
+		t.Errorf("Expected ErrInvalid, got %v", err)
+	}
+
+	for _, window := range []int{0xE001, 0x1000, 0x3000, 0x1F140, 0x10FFC0 + 0x40} {
+		if _, err := EncodeWith("a", Options{PrivateWindow: window}); err != ErrInvalidPrivateWindow {
+			t.Errorf("Window 0x%04X: expected ErrInvalidPrivateWindow, got %v", window, err)
+		}
+		if _, err := DecodeWith([]byte("a"), Options{PrivateWindow: window}); err != ErrInvalidPrivateWindow {
+			t.Errorf("Window 0x%04X: expected ErrInvalidPrivateWindow, got %v", window, err)
+		}
+	}
+	if _, err := EncodeWith("\U0010FFFF", Options{PrivateWindow: 0x10FFC0}); err != nil {
+		t.Errorf("Unexpected error for the last window: %v", err)
+	}
+}
+
+func TestLatinAux(t *testing.T) {
+	// Trade "-" for "/"
+	opts := Options{LatinAux: [][]int{{'A', 'Z' + 1}, {'a', 'z' + 1}, {'0', '9' + 1}, {' ', ' ' + 1}, {'/', '/' + 1}}}
+	str := "Диск/Папка/Файл"
+	custom, err := EncodeWith(str, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ctrl, err := DecodeWith(custom, opts); err != nil || ctrl != str {
+		t.Errorf("String '%v' decoded back as '%v' (%v)", str, ctrl, err)
+	}
+	if len(custom) >= len(Encode(str)) {
+		t.Errorf("Custom LatinAux did not reduce size: %v vs %v", len(custom), len(Encode(str)))
+	}
+	for _, test := range testStrings {
+		buf, _ := EncodeWith(test, opts)
+		if ctrl, err := DecodeWith(buf, opts); err != nil || ctrl != test {
+			t.Errorf("String '%v' decoded back as '%v' (%v)", test, ctrl, err)
+		}
+	}
+	// The default set gives the default encoding
+	if buf, _ := EncodeWith(str, Options{LatinAux: rangesLatin}); !bytes.Equal(buf, Encode(str)) {
+		t.Errorf("String '%v' encoded as %v, expected %v", str, hexString(buf), hexString(Encode(str)))
+	}
+	// Unused slots are invalid
+	small := Options{LatinAux: [][]int{{'a', 'c'}}}
+	if _, err := DecodeWith([]byte{0x84, 0x10, 0xC2}, small); !errors.Is(err, ErrInvalid) {
+		t.Errorf("Expected ErrInvalid, got %v", err)
+	}
+
+	for _, ranges := range [][][]int{
+		{{'a', 'a'}},
+		{{'b', 'a'}},
+		{{'a'}},
+		{{-1, 'a'}},
+		{{'a', 'z'}, {'x', 'z' + 1}},
+		{{0, 0x41}},
+	} {
+		if _, err := EncodeWith("a", Options{LatinAux: ranges}); err != ErrInvalidLatinAux {
+			t.Errorf("Ranges %v: expected ErrInvalidLatinAux, got %v", ranges, err)
+		}
+		if _, err := DecodeWith([]byte("a"), Options{LatinAux: ranges}); err != ErrInvalidLatinAux {
+			t.Errorf("Ranges %v: expected ErrInvalidLatinAux, got %v", ranges, err)
+		}
+	}
+}
+
+func TestValidate(t *testing.T) {
+	for _, test := range []struct {
+		opts Options
+		err  error
+	}{
+		{Options{}, nil},
+		{Options{AuxOffsets: map[int]int{0x0500: 0x0540, 0x0400: 0, 0x0080: 0x0080}, LatinAux: [][]int{{'a', 'z' + 1}}, PrivateWindow: 0xE000}, nil},
+		{Options{AuxOffsets: map[int]int{0x0530: 0x0531}}, ErrInvalidAuxOffsets}, // Key is not an alphabet offset
+		{Options{AuxOffsets: map[int]int{-0x80: 0}}, ErrInvalidAuxOffsets},
+		{Options{AuxOffsets: map[int]int{0x0500: 0x0541}}, ErrInvalidAuxOffsets}, // Window crosses the end of the alphabet
+		{Options{AuxOffsets: map[int]int{0x0500: 0x04FF}}, ErrInvalidAuxOffsets}, // Window starts before the alphabet
+		{Options{AuxOffsets: map[int]int{0x0000: 0x00C0}}, nil},                  // Latin alphabet extends to U+02FF
+		{Options{AuxOffsets: map[int]int{0x0000: 0x02C1}}, ErrInvalidAuxOffsets},
+		{Options{AuxOffsets: map[int]int{0x0000: -5}}, ErrInvalidAuxOffsets},
+		{Options{AuxOffsets: map[int]int{0x0000: -0x40}}, ErrInvalidAuxOffsets},
+		{Options{LatinAux: [][]int{{'a'}}}, ErrInvalidLatinAux},
+		{Options{LatinAux: [][]int{{'z', 'a'}}}, ErrInvalidLatinAux},
+		{Options{LatinAux: [][]int{{'a', 'z' + 1}, {'x', 'x' + 1}}}, ErrInvalidLatinAux},
+		{Options{LatinAux: [][]int{{0, 0x41}}}, ErrInvalidLatinAux},
+		{Options{PrivateWindow: 0xE001}, ErrInvalidPrivateWindow},
+		{Options{PrivateWindow: 0x2000}, ErrInvalidPrivateWindow},
+		{Options{RestartInterval: -1}, ErrInvalidRestartInterval},
+	} {
+		if err := test.opts.Validate(); err != test.err {
+			t.Errorf("Options %+v: expected %v, got %v", test.opts, test.err, err)
+		}
+		// Both directions should reject invalid options before doing anything
+		if _, err := EncodeWith("a", test.opts); err != test.err {
+			t.Errorf("Options %+v: EncodeWith returned %v, expected %v", test.opts, err, test.err)
+		}
+		if _, err := DecodeWith([]byte("a"), test.opts); err != test.err {
+			t.Errorf("Options %+v: DecodeWith returned %v, expected %v", test.opts, err, test.err)
+		}
+	}
+	// Options can be checked right where they're declared
+	if err := (Options{PrivateWindow: 0xE001}).Validate(); err != ErrInvalidPrivateWindow {
+		t.Errorf("Expected ErrInvalidPrivateWindow, got %v", err)
+	}
+}
+
+func TestRestartInterval(t *testing.T) {
+	strs := append([]string{"Привет, мир! 日本語 ひらがな 🔥🔥 Ελλάδα \U0010FFFF abc"}, testStrings...)
+	for _, str := range strs {
+		runes := []rune(str)
+		for _, interval := range []int{1, 3, 8, 1000} {
+			opts := Options{RestartInterval: interval}
+			buf, restarts, err := EncodeWithRestarts(str, opts)
+			if ctrl, derr := DecodeWith(buf, opts); err != nil || derr != nil || ctrl != str {
+				t.Errorf("String '%v' (interval %v) decoded back as '%v' (%v, %v)", str, interval, ctrl, err, derr)
+			}
+			if withOpts, _ := EncodeWith(str, opts); !bytes.Equal(buf, withOpts) {
+				t.Errorf("String '%v' (interval %v) encoded differently by EncodeWith", str, interval)
+			}
+			if expected := (len(runes) - 1) / interval; len(runes) > 0 && len(restarts) != expected {
+				t.Errorf("String '%v' (interval %v) has %v restart points, expected %v", str, interval, len(restarts), expected)
+			}
+			// Joining at any restart point gives the rest of the string
+			for j, offset := range restarts {
+				k := (j + 1) * interval
+				if rest, err := DecodeWith(buf[offset:], opts); err != nil || rest != string(runes[k:]) {
+					t.Errorf("String '%v' (interval %v) decoded from restart point %v as '%v' (%v)", str, interval, j, rest, err)
+				}
+			}
+		}
+	}
+	if _, _, err := EncodeWithRestarts("abc", Options{RestartInterval: 2, EscapeNewlines: true}); err != ErrRestartsEscaped {
+		t.Errorf("Expected ErrRestartsEscaped, got %v", err)
+	}
+	// Restarts cost a switch back to the current alphabet
+	str := strings.Repeat("Привет мир ", 10)
+	if buf, _ := EncodeWith(str, Options{RestartInterval: 11}); len(buf) != len(Encode(str))+9 {
+		t.Errorf("Restarts added %v bytes, expected 9", len(buf)-len(Encode(str)))
+	}
+}
+
+func TestEscapeNewlines(t *testing.T) {
+	opts := Options{EscapeNewlines: true}
+	strs := append([]string{
+		"line 1\nline 2\n\n",
+		"Њујорк\nЉубљана\n", // U+040A is 0x0A in Cyrillic alphabet
+		"Ċ\n\U0001F60A\n⠊",  // and it appears in lower bytes of longer sequences
+		strings.Repeat("a\nb", 200),
+		strings.Repeat("x", 600),
+	}, testStrings...)
+	for _, str := range strs {
+		buf, err := EncodeWith(str, opts)
+		if err != nil || bytes.IndexByte(buf, '\n') >= 0 {
+			t.Errorf("String %+q encoded with newlines as % x (%v)", str, buf, err)
+		}
+		if len(buf) > len(Encode(str))+len(Encode(str))/254+1 {
+			t.Errorf("String %+q takes %v bytes with escaping, %v without", str, len(buf), len(Encode(str)))
+		}
+		if ctrl, err := DecodeWith(buf, opts); err != nil || ctrl != str {
+			t.Errorf("String %+q decoded back as %+q (%v)", str, ctrl, err)
+		}
+	}
+	var decodeErr *DecodeError
+	for _, buf := range [][]byte{{'\n'}, {0x0E, 'a', 'b'}, {0x09, 'a', '\n'}} {
+		if _, err := DecodeWith(buf, opts); !errors.As(err, &decodeErr) || decodeErr.Offset != 0 {
+			t.Errorf("Expected invalid stuffing at offset 0 for % x, got %v", buf, err)
+		}
+	}
+}
@@ -0,0 +1,29 @@
+package utfc
+
+import "sync"
+
+// Buffers larger than this are not returned to the pool, so one huge string doesn't pin memory forever
+const maxPooledBufferSize = 64 * 1024
+
+var bufferPool = sync.Pool{
+	New: func() interface{} {
+		return make([]byte, 0, 64)
+	},
+}
+
+// EncodePooled converts string to an UTF-C byte array, same as Encode, but takes the output buffer from a package-level pool.
+// The caller owns the returned slice until it passes it to ReleaseBuffer; after that the slice must not be used
+// (not even read), since it may be handed out to another goroutine. Not releasing a buffer is safe, it's just garbage collected.
+func EncodePooled(str string) []byte {
+	buf := bufferPool.Get().([]byte)
+	return AppendEncode(buf[:0], str)
+}
+
+// ReleaseBuffer returns a buffer obtained from EncodePooled to the pool. Each buffer must be released at most once.
+func ReleaseBuffer(buf []byte) {
+	if cap(buf) > maxPooledBufferSize {
+		return
+	}
+	// Boxing the slice header allocates a few bytes, which is still much less than a new buffer
+	bufferPool.Put(buf[:0])
+}
@@ -0,0 +1,41 @@
+package utfc
+
+import (
+	"bytes"
+	"testing"
+)
+
+func TestEncodePooled(t *testing.T) {
+	for _, test := range testStrings {
+		buf := EncodePooled(test)
+		if !bytes.Equal(buf, Encode(test)) {
+			t.Errorf("String '%v' encoded as %v, expected %v", test, hexString(buf), hexString(Encode(test)))
+		}
+		ReleaseBuffer(buf)
+	}
+	// Oversized buffers are dropped instead of being pooled
+	ReleaseBuffer(make([]byte, 0, maxPooledBufferSize+1))
+	if buf := EncodePooled("abc"); cap(buf) > maxPooledBufferSize {
+		t.Errorf("Got an oversized buffer from the pool: %v", cap(buf))
+	}
+}
+
+func BenchmarkEncodeParallel(b *testing.B) {
+	str := testStrings[39]
+	b.Run("Encode", func(b *testing.B) {
+		b.ReportAllocs()
+		b.RunParallel(func(pb *testing.PB) {
+			for pb.Next() {
+				Encode(str)
+			}
+		})
+	})
+	b.Run("EncodePooled", func(b *testing.B) {
+		b.ReportAllocs()
+		b.RunParallel(func(pb *testing.PB) {
+			for pb.Next() {
+				ReleaseBuffer(EncodePooled(str))
+			}
+		})
+	})
+}
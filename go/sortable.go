@@ -0,0 +1,61 @@
+package utfc
+
+import "unicode/utf8"
+
+// EncodeSortable converts string to a stateless variable-length encoding that preserves the order:
+// comparing two encoded buffers with bytes.Compare gives the same result as comparing codepoints
+// of the original strings. It's not UTF-C and must be decoded with DecodeSortable.
+//
+// Each codepoint is encoded as:
+//
+//	0xxxxxxx                            for U+0000-U+007F,
+//	10xxxxxx xxxxxxxx                   for U+0080-U+3FFF,
+//	11xxxxxx xxxxxxxx xxxxxxxx          for the rest.
+//
+// Lead bytes of longer sequences are greater, and the code is prefix-free, so byte order follows codepoint order.
+// Compared to UTF-8 (which is sortable too), it saves a byte for U+0800-U+3FFF and for supplementary planes,
+// but it's larger than the stateful UTF-C for most alphabetic scripts.
+func EncodeSortable(str string) []byte {
+	buf := make([]byte, 0, len(str))
+	for _, ch := range str {
+		cp := int(ch)
+		if cp < 0x80 {
+			buf = append(buf, byte(cp))
+		} else if cp < 0x4000 {
+			buf = append(buf, byte(0x80|cp>>8), byte(cp))
+		} else {
+			buf = append(buf, byte(0xC0|cp>>16), byte(cp>>8), byte(cp))
+		}
+	}
+	return buf
+}
+
+// DecodeSortable converts a buffer produced by EncodeSortable back to the string, returning a *DecodeError if it's malformed.
+// Overlong sequences (encoding a codepoint that fits a shorter one) are malformed too.
+func DecodeSortable(buf []byte) (string, error) {
+	out := make([]byte, 0, len(buf))
+	for i := 0; i < len(buf); {
+		cp, n := int(buf[i]), 1
+		if cp >= 0xC0 {
+			n = 3
+		} else if cp >= 0x80 {
+			n = 2
+		}
+		if i+n > len(buf) {
+			return "", &DecodeError{Offset: i, Err: ErrTruncated}
+		}
+		minCp := 0 // Overlong forms are rejected, so that each string has a single encoding
+		switch n {
+		case 2:
+			cp, minCp = (cp^0x80)<<8|int(buf[i+1]), 0x80
+		case 3:
+			cp, minCp = (cp^0xC0)<<16|int(buf[i+1])<<8|int(buf[i+2]), 0x4000
+		}
+		if cp < minCp || !utf8.ValidRune(rune(cp)) {
+			return "", &DecodeError{Offset: i, Err: ErrInvalid}
+		}
+		out = appendRune(out, cp)
+		i += n
+	}
+	return string(out), nil
+}
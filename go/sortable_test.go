@@ -0,0 +1,53 @@
+package utfc
+
+import (
+	"bytes"
+	"errors"
+	"math/rand"
+	"sort"
+	"strings"
+	"testing"
+)
+
+func TestSortable(t *testing.T) {
+	for _, test := range testStrings {
+		buf := EncodeSortable(test)
+		if ctrl, err := DecodeSortable(buf); err != nil || ctrl != test {
+			t.Errorf("String '%v' decoded back as '%v' (%v)", test, ctrl, err)
+		}
+	}
+
+	// Boundaries of each sequence length
+	strs := []string{"", "\x00", "\x7F", "\u0080", "㿿", "䀀", "￿", "\U00010000", "\U0010FFFF", "a", "ab", "b"}
+	alphabet := []rune("aZ-é€Мש日か🔥\U00012000㿿䀀")
+	rnd := rand.New(rand.NewSource(1))
+	for i := 0; i < 1000; i++ {
+		runes := make([]rune, rnd.Intn(5))
+		for j := range runes {
+			runes[j] = alphabet[rnd.Intn(len(alphabet))]
+		}
+		strs = append(strs, string(runes))
+	}
+	// For valid UTF-8 strings comparison is the same as comparison of codepoints
+	sort.Strings(strs)
+	for i := 1; i < len(strs); i++ {
+		a, b := EncodeSortable(strs[i-1]), EncodeSortable(strs[i])
+		if c := bytes.Compare(a, b); c != strings.Compare(strs[i-1], strs[i]) {
+			t.Errorf("Encoded '%v' and '%v' compare as %v", strs[i-1], strs[i], c)
+		}
+	}
+
+	if _, err := DecodeSortable([]byte{'a', 0xC0, 0x40}); !errors.Is(err, ErrTruncated) {
+		t.Errorf("Expected ErrTruncated, got %v", err)
+	}
+	for _, buf := range [][]byte{
+		{0xFF, 0xFF, 0xFF},
+		{0x80, 'a'},             // Overlong "a"
+		{0xC0, 0x3F, 0xFF},      // Overlong U+3FFF
+		{'a', 0xC0, 0x00, 0x80}, // Overlong U+0080
+	} {
+		if _, err := DecodeSortable(buf); !errors.Is(err, ErrInvalid) {
+			t.Errorf("Expected ErrInvalid for %v, got %v", hexString(buf), err)
+		}
+	}
+}
@@ -0,0 +1,61 @@
+package utfc
+
+// SplitByRunes splits UTF-C data into segments of runesPerSegment characters each (the last one can be shorter).
+// Each segment is re-encoded from the initial state, so it can be decoded on its own.
+// It panics if runesPerSegment is less than 1.
+func SplitByRunes(buf []byte, runesPerSegment int) [][]byte {
+	if runesPerSegment < 1 {
+		panic("utfc: runesPerSegment must be positive")
+	}
+	opts := Options{}
+	var segments [][]byte
+	var segment []byte
+	enc := initState()
+	dec := initState()
+	runes := 0
+	for i := 0; i < len(buf); {
+		cp, n, err := dec.decodeRune(buf, i, &opts)
+		if err != nil {
+			break
+		}
+		i += n
+		if runes == runesPerSegment {
+			segments = append(segments, segment)
+			segment, enc, runes = nil, initState(), 0
+		}
+		segment = enc.encodeRune(segment, normalizeRune(cp), &opts)
+		runes++
+	}
+	if runes > 0 {
+		segments = append(segments, segment)
+	}
+	return segments
+}
+
+// EncodeFrames encodes str and splits the output into frames of at most maxFrameBytes bytes each.
+// Every frame is encoded from the initial state, so it can be decoded on its own, and the decoded frames
+// concatenated in order give the original string. It panics if maxFrameBytes is less than 3 (the longest sequence).
+func EncodeFrames(str string, maxFrameBytes int) [][]byte {
+	if maxFrameBytes < 3 {
+		panic("utfc: maxFrameBytes must be at least 3")
+	}
+	opts := Options{}
+	var frames [][]byte
+	var frame []byte
+	st := initState()
+	scratch := [3]byte{}
+	for _, ch := range str {
+		seq := st.encodeRune(scratch[:0], int(ch), &opts)
+		if len(frame)+len(seq) > maxFrameBytes {
+			// Start a new frame, where the character may take a different number of bytes
+			frames = append(frames, frame)
+			frame, st = nil, initState()
+			seq = st.encodeRune(scratch[:0], int(ch), &opts)
+		}
+		frame = append(frame, seq...)
+	}
+	if len(frame) > 0 {
+		frames = append(frames, frame)
+	}
+	return frames
+}
@@ -0,0 +1,66 @@
+package utfc
+
+import "testing"
+
+func TestSplitByRunes(t *testing.T) {
+	for _, test := range testStrings {
+		runes := []rune(test)
+		for _, n := range []int{1, 3, 10, len(runes)} {
+			segments := SplitByRunes(Encode(test), n)
+			if expected := (len(runes) + n - 1) / n; len(segments) != expected {
+				t.Errorf("String '%v' split into %v segments of %v runes, expected %v", test, len(segments), n, expected)
+			}
+			for i, segment := range segments {
+				end := (i + 1) * n
+				if end > len(runes) {
+					end = len(runes)
+				}
+				if str, expected := Decode(segment), string(runes[i*n:end]); str != expected {
+					t.Errorf("Segment %v of '%v' decoded as '%v', expected '%v'", i, test, str, expected)
+				}
+			}
+		}
+	}
+	if segments := SplitByRunes(nil, 5); len(segments) != 0 {
+		t.Errorf("Expected no segments for empty input, got %v", segments)
+	}
+}
+
+func TestEncodeFrames(t *testing.T) {
+	strs := append([]string{"Привет日本語🔥мир abc ひらがな \U0010FFFF Ελλάδα"}, testStrings...)
+	for _, str := range strs {
+		for _, max := range []int{3, 4, 5, 8, 64, 1500} {
+			frames := EncodeFrames(str, max)
+			joined := ""
+			for i, frame := range frames {
+				if len(frame) > max || len(frame) == 0 {
+					t.Errorf("Frame %v of '%v' takes %v bytes, limit is %v", i, str, len(frame), max)
+				}
+				decoded, err := DecodeSafe(frame)
+				if err != nil {
+					t.Errorf("Frame %v of '%v' failed to decode: %v", i, str, err)
+				}
+				joined += decoded
+			}
+			if joined != str {
+				t.Errorf("Frames of '%v' (limit %v) decoded as '%v'", str, max, joined)
+			}
+			if len(Encode(str)) <= max && len(frames) > 1 {
+				t.Errorf("String '%v' fits into %v bytes, but was split into %v frames", str, max, len(frames))
+			}
+		}
+	}
+	if frames := EncodeFrames("", 3); len(frames) != 0 {
+		t.Errorf("Expected no frames for an empty string, got %v", frames)
+	}
+	// Every frame starts from the initial state, so "ж" in the second frame needs a switch again
+	if frames := EncodeFrames("Жжж", 3); len(frames) != 2 || len(frames[0]) != 3 || len(frames[1]) != 2 {
+		t.Errorf("Unexpected frames %v", frames)
+	}
+	defer func() {
+		if recover() == nil {
+			t.Errorf("Expected a panic for maxFrameBytes < 3")
+		}
+	}()
+	EncodeFrames("a", 2)
+}
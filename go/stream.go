@@ -0,0 +1,381 @@
+package utfc
+
+import (
+	"bufio"
+	"errors"
+	"io"
+	"io/ioutil"
+	"unicode/utf8"
+)
+
+// ErrInputTooLarge is returned by DecodeReaderLimit if the input is longer than the limit
+var ErrInputTooLarge = errors.New("utfc: input exceeds the size limit")
+
+// EncodeChan encodes runes received from `in` and sends the resulting bytes to the returned channel.
+// The output channel is closed after `in` is closed and all the bytes are sent.
+func EncodeChan(in <-chan rune) <-chan byte {
+	out := make(chan byte)
+	go func() {
+		defer close(out)
+		st := initState()
+		opts := Options{}
+		var buf []byte
+		for ch := range in {
+			buf = st.encodeRune(buf[:0], int(ch), &opts)
+			for _, b := range buf {
+				out <- b
+			}
+		}
+	}()
+	return out
+}
+
+// DecodeChan decodes bytes received from `in` and sends the resulting runes to the returned channel.
+// Invalid codepoints are replaced with U+FFFD, as well as a truncated sequence at the end of the input.
+// The output channel is closed after `in` is closed and all the runes are sent.
+func DecodeChan(in <-chan byte) <-chan rune {
+	out := make(chan rune)
+	go func() {
+		defer close(out)
+		st := initState()
+		opts := Options{}
+		buf := make([]byte, 0, 3)
+		for b := range in {
+			buf = append(buf, b)
+			cp, _, err := st.decodeRune(buf, 0, &opts)
+			if err == ErrTruncated {
+				continue // Wait for the rest of the sequence
+			}
+			buf = buf[:0]
+			if !utf8.ValidRune(rune(cp)) {
+				cp = utf8.RuneError
+			}
+			out <- rune(cp)
+		}
+		if len(buf) > 0 {
+			out <- utf8.RuneError
+		}
+	}()
+	return out
+}
+
+// Encoder converts UTF-8 text written to it into UTF-C and writes the result to the underlying writer.
+// The state is kept between writes, so the output is the same as Encode of the whole input.
+// Besides a few words of state, Encoder holds only an incomplete rune between writes and
+// a scratch buffer reused for the output of each Write.
+type Encoder struct {
+	w       io.Writer
+	st      state
+	partial [utf8.UTFMax]byte // Incomplete UTF-8 sequence from the end of the previous Write
+	n       int
+	buf     []byte
+}
+
+// NewEncoder returns a new Encoder writing to w
+func NewEncoder(w io.Writer) *Encoder {
+	return &Encoder{w: w, st: initState()}
+}
+
+// Write encodes p and writes the result to the underlying writer.
+// An incomplete UTF-8 sequence at the end of p is buffered until the next Write or Close.
+func (e *Encoder) Write(p []byte) (int, error) {
+	opts := Options{}
+	buf := e.buf[:0]
+	i := 0
+	if e.n > 0 {
+		// Decode runes that start in the bytes left from the previous call
+		k := len(p)
+		if k > utf8.UTFMax {
+			k = utf8.UTFMax
+		}
+		head := append(e.partial[:e.n:e.n], p[:k]...)
+		j := 0
+		for j < e.n {
+			if !utf8.FullRune(head[j:]) {
+				// All of p fits into the incomplete sequence
+				e.n = copy(e.partial[:], head[j:])
+				return e.flush(buf, len(p))
+			}
+			ch, size := utf8.DecodeRune(head[j:])
+			buf = e.st.encodeRune(buf, int(ch), &opts)
+			j += size
+		}
+		i = j - e.n
+		e.n = 0
+	}
+	for i < len(p) {
+		if !utf8.FullRune(p[i:]) {
+			e.n = copy(e.partial[:], p[i:])
+			break
+		}
+		ch, size := utf8.DecodeRune(p[i:])
+		buf = e.st.encodeRune(buf, int(ch), &opts)
+		i += size
+	}
+	return e.flush(buf, len(p))
+}
+
+func (e *Encoder) flush(buf []byte, n int) (int, error) {
+	e.buf = buf
+	if len(buf) == 0 {
+		return n, nil
+	}
+	if _, err := e.w.Write(buf); err != nil {
+		return 0, err
+	}
+	return n, nil
+}
+
+// Close encodes the buffered incomplete UTF-8 sequence (as U+FFFD) if there's one.
+// It does not close the underlying writer.
+func (e *Encoder) Close() error {
+	if e.n == 0 {
+		return nil
+	}
+	e.n = 0
+	buf := e.st.encodeRune(e.buf[:0], utf8.RuneError, &Options{})
+	_, err := e.w.Write(buf)
+	return err
+}
+
+// BufferedBytes returns the number of input bytes held by the encoder (a part of an incomplete rune)
+func (e *Encoder) BufferedBytes() int {
+	return e.n
+}
+
+// Decoder reads UTF-C data from the underlying reader and returns it as UTF-8 text.
+// Malformed input is reported as a *DecodeError after all the preceding text is returned.
+type Decoder struct {
+	r    io.Reader
+	st   state
+	in   []byte // Encoded bytes that were read but not decoded yet
+	out  []byte // Decoded bytes that were not returned yet
+	offs int    // Offset of in[0] in the input stream
+	err  error
+}
+
+// NewDecoder returns a new Decoder reading from r
+func NewDecoder(r io.Reader) *Decoder {
+	return &Decoder{r: r, st: initState()}
+}
+
+// Read reads decoded UTF-8 text into p
+func (d *Decoder) Read(p []byte) (int, error) {
+	for len(d.out) == 0 {
+		if d.err != nil {
+			return 0, d.err
+		}
+		d.fill()
+	}
+	n := copy(p, d.out)
+	d.out = d.out[n:]
+	return n, nil
+}
+
+// fill reads the next chunk from the underlying reader and decodes all complete sequences in it
+func (d *Decoder) fill() {
+	const chunkSize = 4096
+	if cap(d.in)-len(d.in) < chunkSize {
+		in := make([]byte, len(d.in), len(d.in)+chunkSize)
+		copy(in, d.in)
+		d.in = in
+	}
+	n, err := d.r.Read(d.in[len(d.in):cap(d.in)])
+	d.in = d.in[:len(d.in)+n]
+
+	opts := Options{}
+	out := d.out[:0]
+	i := 0
+	for i < len(d.in) {
+		st := d.st
+		cp, size, derr := st.decodeRune(d.in, i, &opts)
+		if derr == ErrTruncated {
+			break // Wait for the rest of the sequence
+		}
+		if !utf8.ValidRune(rune(cp)) {
+			err = &DecodeError{Offset: d.offs + i, Err: ErrInvalid}
+			break
+		}
+		d.st = st
+		out = appendRune(out, cp)
+		i += size
+	}
+	d.out = out
+	d.offs += i
+	d.in = d.in[:copy(d.in, d.in[i:])]
+
+	if err == io.EOF && len(d.in) > 0 {
+		err = &DecodeError{Offset: d.offs, Err: ErrTruncated}
+	}
+	d.err = err
+}
+
+// BufferedBytes returns the number of bytes held by the decoder (encoded input and decoded output that wasn't read yet)
+func (d *Decoder) BufferedBytes() int {
+	return len(d.in) + len(d.out)
+}
+
+// ByteReader decodes UTF-C data lazily, returning UTF-8 bytes of the text one at a time.
+// It produces the same bytes as Decode.
+type ByteReader struct {
+	buf     []byte
+	i       int
+	st      state
+	pending [utf8.UTFMax]byte // UTF-8 bytes of the current rune
+	pos, n  int
+}
+
+// NewByteReader returns a new ByteReader decoding buf
+func NewByteReader(buf []byte) *ByteReader {
+	return &ByteReader{buf: buf, st: initState()}
+}
+
+// ReadByte returns the next byte of the decoded text or io.EOF at the end
+func (r *ByteReader) ReadByte() (byte, error) {
+	if r.pos == r.n {
+		if r.i >= len(r.buf) {
+			return 0, io.EOF
+		}
+		cp, size, err := r.st.decodeRune(r.buf, r.i, &Options{})
+		if err != nil {
+			// Truncated sequence at the end is ignored
+			r.i = len(r.buf)
+			return 0, io.EOF
+		}
+		r.i += size
+		r.pos, r.n = 0, utf8.EncodeRune(r.pending[:], rune(cp))
+	}
+	b := r.pending[r.pos]
+	r.pos++
+	return b, nil
+}
+
+// EncodeRuneReader reads all runes from r (until io.EOF) and returns their UTF-C encoding.
+// It accepts *strings.Reader, *bufio.Reader and other rune readers without copying their content into a string.
+func EncodeRuneReader(r io.RuneReader) ([]byte, error) {
+	opts := Options{}
+	st := initState()
+	buf := []byte{}
+	for {
+		ch, _, err := r.ReadRune()
+		if err == io.EOF {
+			return buf, nil
+		}
+		if err != nil {
+			return buf, err
+		}
+		buf = st.encodeRune(buf, int(ch), &opts)
+	}
+}
+
+// Maximum size of the output buffered by EncodeTo before writing it
+const encodeToChunkSize = 32 * 1024
+
+// EncodeTo writes UTF-C encoding of str to w, writing the output in chunks of about 32 Kb.
+// Unlike Encode, it never holds the whole output in memory, so it's suitable for very large strings.
+func EncodeTo(w io.Writer, str string) error {
+	opts := Options{}
+	st := initState()
+	buf := make([]byte, 0, encodeToChunkSize+utf8.UTFMax)
+	for _, ch := range str {
+		buf = st.encodeRune(buf, int(ch), &opts)
+		if len(buf) >= encodeToChunkSize {
+			if _, err := w.Write(buf); err != nil {
+				return err
+			}
+			buf = buf[:0]
+		}
+	}
+	if len(buf) > 0 {
+		if _, err := w.Write(buf); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// ByteSink is the minimal destination for EncodeInto. It's the same as io.ByteWriter,
+// so *bytes.Buffer, *bufio.Writer and *strings.Builder satisfy it.
+type ByteSink = io.ByteWriter
+
+// EncodeInto writes UTF-C encoding of str to sink byte by byte, stopping at the first error returned by sink
+func EncodeInto(sink ByteSink, str string) error {
+	opts := Options{}
+	st := initState()
+	scratch := [3]byte{}
+	for _, ch := range str {
+		for _, b := range st.encodeRune(scratch[:0], int(ch), &opts) {
+			if err := sink.WriteByte(b); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// EncodeLines encodes lines read by scanner to w, inserting sep between them. sep is UTF-8 text (for example, "\n")
+// and is encoded along with the lines, keeping the state, so the output is the same as Encode of the lines joined by sep.
+// It returns the first error of the writer or the scanner.
+func EncodeLines(scanner *bufio.Scanner, w io.Writer, sep []byte) error {
+	enc := NewEncoder(w)
+	for first := true; scanner.Scan(); first = false {
+		if !first {
+			if _, err := enc.Write(sep); err != nil {
+				return err
+			}
+		}
+		if _, err := enc.Write(scanner.Bytes()); err != nil {
+			return err
+		}
+	}
+	if err := enc.Close(); err != nil {
+		return err
+	}
+	return scanner.Err()
+}
+
+// DecodeReaderLimit reads all UTF-C data from r (until io.EOF) and decodes it like DecodeSafe.
+// At most maxBytes+1 bytes are read: if r has more than maxBytes, ErrInputTooLarge is returned without decoding.
+func DecodeReaderLimit(r io.Reader, maxBytes int) (string, error) {
+	buf, err := ioutil.ReadAll(io.LimitReader(r, int64(maxBytes)+1))
+	if err != nil {
+		return "", err
+	}
+	if len(buf) > maxBytes {
+		return "", ErrInputTooLarge
+	}
+	return DecodeSafe(buf)
+}
+
+// ValidStream reads r until io.EOF and reports whether it's well-formed UTF-C data, like Valid, without
+// holding more than a small chunk of it in memory. If it's malformed, firstErrorByte is the offset
+// of the first invalid (or truncated) sequence, otherwise it's -1. A non-nil err is returned only for read errors.
+func ValidStream(r io.Reader) (valid bool, firstErrorByte int64, err error) {
+	const chunkSize = 4096
+	opts := Options{}
+	st := initState()
+	buf := make([]byte, 0, chunkSize+utf8.UTFMax)
+	offs := int64(0) // Offset of buf[0] in the stream
+	for {
+		n, rerr := r.Read(buf[len(buf):cap(buf)])
+		buf = buf[:len(buf)+n]
+		i := 0
+		for i < len(buf) {
+			cp, size, derr := st.decodeRune(buf, i, &opts)
+			if derr == ErrTruncated && rerr != io.EOF {
+				break // Wait for the rest of the sequence
+			}
+			if derr != nil || !utf8.ValidRune(rune(cp)) {
+				return false, offs + int64(i), nil
+			}
+			i += size
+		}
+		offs += int64(i)
+		buf = buf[:copy(buf, buf[i:])]
+		if rerr == io.EOF {
+			return true, -1, nil
+		} else if rerr != nil {
+			return false, -1, rerr
+		}
+	}
+}
@@ -0,0 +1,355 @@
+package utfc
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"io"
+	"io/ioutil"
+	"strings"
+	"testing"
+	"testing/iotest"
+	"time"
+)
+
+func TestChan(t *testing.T) {
+	for _, test := range testStrings {
+		runes := make(chan rune)
+		go func() {
+			for _, ch := range test {
+				runes <- ch
+			}
+			close(runes)
+		}()
+
+		encoded := EncodeChan(runes)
+		buf := []byte{}
+		decoded := DecodeChan(relay(encoded, &buf))
+		ctrl := ""
+		for ch := range decoded {
+			ctrl += string(ch)
+		}
+		if ctrl != test {
+			t.Errorf("String '%v' decoded back as '%v'", test, ctrl)
+		}
+		if enc := Encode(test); string(enc) != string(buf) {
+			t.Errorf("String '%v' encoded as %v, expected %v", test, hexString(buf), hexString(enc))
+		}
+	}
+}
+
+// relay passes bytes through, collecting them into buf
+func relay(in <-chan byte, buf *[]byte) <-chan byte {
+	out := make(chan byte)
+	go func() {
+		defer close(out)
+		for b := range in {
+			*buf = append(*buf, b)
+			out <- b
+		}
+	}()
+	return out
+}
+
+func TestDecodeChanTruncated(t *testing.T) {
+	in := make(chan byte, 3)
+	in <- 'a'
+	in <- marker21Bit
+	in <- 0x01
+	close(in)
+
+	out := DecodeChan(in)
+	expected := []rune{'a', '�'}
+	for i := 0; ; i++ {
+		select {
+		case ch, ok := <-out:
+			if !ok {
+				if i != len(expected) {
+					t.Errorf("Expected %v runes, got %v", len(expected), i)
+				}
+				return
+			}
+			if i >= len(expected) || ch != expected[i] {
+				t.Errorf("Unexpected rune %q at %v", ch, i)
+			}
+		case <-time.After(time.Second):
+			t.Fatal("Output channel was not closed")
+		}
+	}
+}
+
+func TestEncoderDecoder(t *testing.T) {
+	for _, test := range testStrings {
+		// Write input in small chunks to split runes between writes
+		var encoded bytes.Buffer
+		enc := NewEncoder(&encoded)
+		for i := 0; i < len(test); i += 3 {
+			end := i + 3
+			if end > len(test) {
+				end = len(test)
+			}
+			if _, err := enc.Write([]byte(test[i:end])); err != nil {
+				t.Fatal(err)
+			}
+		}
+		if err := enc.Close(); err != nil {
+			t.Fatal(err)
+		}
+		if buf := Encode(test); !bytes.Equal(encoded.Bytes(), buf) {
+			t.Errorf("String '%v' encoded as %v, expected %v", test, hexString(encoded.Bytes()), hexString(buf))
+		}
+
+		decoded, err := ioutil.ReadAll(NewDecoder(iotest.OneByteReader(&encoded)))
+		if err != nil || string(decoded) != test {
+			t.Errorf("String '%v' decoded back as '%v' (%v)", test, string(decoded), err)
+		}
+	}
+}
+
+func TestEncoderBufferedBytes(t *testing.T) {
+	var encoded bytes.Buffer
+	enc := NewEncoder(&encoded)
+	str := []byte("ab€")
+	enc.Write(str[:3])
+	if n := enc.BufferedBytes(); n != 1 {
+		t.Errorf("Expected 1 buffered byte, got %v", n)
+	}
+	enc.Write(str[3:4])
+	if n := enc.BufferedBytes(); n != 2 {
+		t.Errorf("Expected 2 buffered bytes, got %v", n)
+	}
+	enc.Write(str[4:])
+	if n := enc.BufferedBytes(); n != 0 {
+		t.Errorf("Expected no buffered bytes, got %v", n)
+	}
+	if Decode(encoded.Bytes()) != string(str) {
+		t.Errorf("Decoded as '%v'", Decode(encoded.Bytes()))
+	}
+
+	// Invalid and incomplete sequences are replaced with U+FFFD
+	encoded.Reset()
+	enc = NewEncoder(&encoded)
+	enc.Write([]byte{0xE2, 0x82})
+	enc.Write([]byte{'a', 0xE2})
+	enc.Close()
+	if str := Decode(encoded.Bytes()); str != "��a�" {
+		t.Errorf("Decoded as '%v'", str)
+	}
+}
+
+func TestDecoderErrors(t *testing.T) {
+	for _, test := range []struct {
+		buf []byte
+		str string
+		err error
+	}{
+		{[]byte{'a', 'b', marker21Bit, 0x00}, "ab", ErrTruncated},
+		{[]byte{'a', 0xBF, 0xFF, 'b'}, "a", ErrInvalid},
+	} {
+		decoded, err := ioutil.ReadAll(NewDecoder(bytes.NewReader(test.buf)))
+		if string(decoded) != test.str || !errors.Is(err, test.err) {
+			t.Errorf("Bytes %v decoded as '%v' (%v), expected '%v' (%v)", hexString(test.buf), string(decoded), err, test.str, test.err)
+		}
+	}
+}
+
+func TestByteReader(t *testing.T) {
+	buffers := [][]byte{{}, {'a', marker21Bit, 0x00}, {'a', 0xBF, 0xFF, 'b'}}
+	for _, test := range testStrings {
+		buffers = append(buffers, Encode(test))
+	}
+	for _, buf := range buffers {
+		r := NewByteReader(buf)
+		decoded := []byte{}
+		for {
+			b, err := r.ReadByte()
+			if err == io.EOF {
+				break
+			}
+			decoded = append(decoded, b)
+		}
+		if expected := []byte(Decode(buf)); !bytes.Equal(decoded, expected) {
+			t.Errorf("Bytes %v read as '%v', expected '%v'", hexString(buf), string(decoded), string(expected))
+		}
+	}
+}
+
+func TestEncodeRuneReader(t *testing.T) {
+	for _, test := range testStrings {
+		buf, err := EncodeRuneReader(strings.NewReader(test))
+		if err != nil || !bytes.Equal(buf, Encode(test)) {
+			t.Errorf("String '%v' encoded as %v (%v), expected %v", test, hexString(buf), err, hexString(Encode(test)))
+		}
+	}
+
+	r := bufio.NewReader(iotest.TimeoutReader(strings.NewReader("abc")))
+	if buf, err := EncodeRuneReader(r); err != iotest.ErrTimeout || string(buf) != "abc" {
+		t.Errorf("Expected partial result and timeout error, got %v (%v)", hexString(buf), err)
+	}
+}
+
+// chunkRecorder records the largest single write
+type chunkRecorder struct {
+	bytes.Buffer
+	maxWrite int
+}
+
+func (w *chunkRecorder) Write(p []byte) (int, error) {
+	if len(p) > w.maxWrite {
+		w.maxWrite = len(p)
+	}
+	return w.Buffer.Write(p)
+}
+
+func TestEncodeTo(t *testing.T) {
+	for _, test := range testStrings {
+		var w bytes.Buffer
+		if err := EncodeTo(&w, test); err != nil || !bytes.Equal(w.Bytes(), Encode(test)) {
+			t.Errorf("String '%v' encoded as %v (%v), expected %v", test, hexString(w.Bytes()), err, hexString(Encode(test)))
+		}
+	}
+
+	str := strings.Repeat(testStrings[33]+testStrings[39], 200)
+	w := &chunkRecorder{}
+	if err := EncodeTo(w, str); err != nil || !bytes.Equal(w.Bytes(), Encode(str)) {
+		t.Errorf("Large string was not encoded correctly (%v)", err)
+	}
+	if w.maxWrite > encodeToChunkSize+3 {
+		t.Errorf("EncodeTo wrote %v bytes at once", w.maxWrite)
+	}
+
+	pr, pw := io.Pipe()
+	pr.Close()
+	if err := EncodeTo(pw, "abc"); err != io.ErrClosedPipe {
+		t.Errorf("Expected io.ErrClosedPipe, got %v", err)
+	}
+}
+
+// countingSink counts written bytes, failing after limit of them if it's positive
+type countingSink struct {
+	n, limit int
+}
+
+var errSinkFull = errors.New("sink is full")
+
+func (s *countingSink) WriteByte(b byte) error {
+	if s.limit > 0 && s.n == s.limit {
+		return errSinkFull
+	}
+	s.n++
+	return nil
+}
+
+func TestEncodeInto(t *testing.T) {
+	for _, test := range testStrings {
+		var sb strings.Builder
+		if err := EncodeInto(&sb, test); err != nil || sb.String() != string(Encode(test)) {
+			t.Errorf("String '%v' encoded as %v (%v), expected %v", test, hexString([]byte(sb.String())), err, hexString(Encode(test)))
+		}
+		sink := &countingSink{}
+		if err := EncodeInto(sink, test); err != nil || sink.n != EncodedLen(test) {
+			t.Errorf("String '%v' encoded in %v bytes (%v), expected %v", test, sink.n, err, EncodedLen(test))
+		}
+	}
+	sink := &countingSink{limit: 3}
+	if err := EncodeInto(sink, "Привет"); err != errSinkFull || sink.n != 3 {
+		t.Errorf("Expected to stop after 3 bytes, got %v after %v", err, sink.n)
+	}
+}
+
+func TestEncodeLines(t *testing.T) {
+	lines := []string{"Hello", "Привет", "", "こんにちは", "שלום 🔥", "Γειά σου"}
+	text := strings.Join(lines, "\r\n") + "\n"
+	var w bytes.Buffer
+	if err := EncodeLines(bufio.NewScanner(strings.NewReader(text)), &w, []byte("\n")); err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(w.Bytes(), Encode(strings.Join(lines, "\n"))) {
+		t.Errorf("Lines encoded as %v, expected %v", hexString(w.Bytes()), hexString(Encode(strings.Join(lines, "\n"))))
+	}
+	if decoded := strings.Split(Decode(w.Bytes()), "\n"); strings.Join(decoded, "|") != strings.Join(lines, "|") {
+		t.Errorf("Lines decoded as %q", decoded)
+	}
+
+	scanner := bufio.NewScanner(iotest.TimeoutReader(iotest.OneByteReader(strings.NewReader("ab\ncd"))))
+	if err := EncodeLines(scanner, ioutil.Discard, []byte("\n")); err != iotest.ErrTimeout {
+		t.Errorf("Expected the scanner error, got %v", err)
+	}
+}
+
+func TestDecodeReaderLimit(t *testing.T) {
+	for _, test := range testStrings {
+		buf := Encode(test)
+		if str, err := DecodeReaderLimit(bytes.NewReader(buf), len(buf)); err != nil || str != test {
+			t.Errorf("String '%v' decoded back as '%v' (%v)", test, str, err)
+		}
+		if len(buf) > 0 {
+			if _, err := DecodeReaderLimit(bytes.NewReader(buf), len(buf)-1); err != ErrInputTooLarge {
+				t.Errorf("String '%v': expected ErrInputTooLarge, got %v", test, err)
+			}
+		}
+	}
+	// Only one byte past the limit is read from an endless producer
+	r := &countingZeroReader{}
+	if _, err := DecodeReaderLimit(r, 100); err != ErrInputTooLarge || r.n != 101 {
+		t.Errorf("Expected ErrInputTooLarge after reading 101 bytes, got %v after %v", err, r.n)
+	}
+	var decodeErr *DecodeError
+	if str, err := DecodeReaderLimit(bytes.NewReader([]byte{'a', 0xA0}), 10); !errors.As(err, &decodeErr) || str != "a" {
+		t.Errorf("Expected a DecodeError, got '%v' (%v)", str, err)
+	}
+	if _, err := DecodeReaderLimit(iotest.TimeoutReader(bytes.NewReader([]byte("ab"))), 10); err != iotest.ErrTimeout {
+		t.Errorf("Expected the reader error, got %v", err)
+	}
+}
+
+// countingZeroReader is an endless stream of zero bytes, counting how many were read
+type countingZeroReader struct {
+	n int
+}
+
+func (r *countingZeroReader) Read(p []byte) (int, error) {
+	for i := range p {
+		p[i] = 0
+	}
+	r.n += len(p)
+	return len(p), nil
+}
+
+func TestValidStream(t *testing.T) {
+	buf := Encode(strings.Repeat(benchmarkScripts["Japanese"]+benchmarkScripts["Emoji"]+"Привет", 30))
+	_, offsets := DecodeWithOffsets(buf)
+	at := offsets[len(offsets)/2]
+	corrupted := append(append(buf[:at:at], 0xBF, 0xFF), buf[at:]...)
+	for _, test := range []struct {
+		buf    []byte
+		valid  bool
+		offset int64
+	}{
+		{nil, true, -1},
+		{buf, true, -1},
+		{corrupted, false, int64(at)},
+		{append(buf[:len(buf):len(buf)], 0xA0, 0x00), false, int64(len(buf))}, // Truncated at the end
+		{[]byte{'a', 0xA0, 0x00}, false, 1},
+	} {
+		if Valid(test.buf) != test.valid {
+			t.Fatalf("Test data of %v bytes is expected to be valid: %v", len(test.buf), test.valid)
+		}
+		for name, r := range map[string]io.Reader{
+			"Reader":     bytes.NewReader(test.buf),
+			"OneByte":    iotest.OneByteReader(bytes.NewReader(test.buf)),
+			"DataErr":    iotest.DataErrReader(bytes.NewReader(test.buf)),
+			"HalfReader": iotest.HalfReader(bytes.NewReader(test.buf)),
+		} {
+			valid, offset, err := ValidStream(r)
+			if valid != test.valid || offset != test.offset || err != nil {
+				t.Errorf("%v of %v bytes: got %v, %v (%v), expected %v, %v", name, len(test.buf), valid, offset, err, test.valid, test.offset)
+			}
+		}
+	}
+	// Read errors are returned as is, even in the middle of a sequence
+	r := io.MultiReader(bytes.NewReader([]byte{'a', 0xA0}), iotest.TimeoutReader(bytes.NewReader([]byte{0x00})))
+	if valid, offset, err := ValidStream(r); valid || offset != -1 || err != iotest.ErrTimeout {
+		t.Errorf("Expected the read error, got %v, %v (%v)", valid, offset, err)
+	}
+}
@@ -1,5 +1,11 @@
 package utfc
 
+import (
+	"errors"
+	"strconv"
+	"unicode/utf8"
+)
+
 // All characters below this code point are considered Latin, so within this range the state of `offs` stays equal to 0
 const maxLatinCp = 0x02FF
 
@@ -15,6 +21,11 @@ const marker13Bit = 0b10000000 // => 2 byte encoding
 const marker21Bit = 0b10100000 // => 3 byte encoding
 const markerExtra = 0b10110000 // => 2 byte encoding, extra ranges
 
+// Extra ranges use only 3744 of 3840 values, so 0xBF 0xA0-0xBF 0xFF are free. 0xBF 0xC0-0xBF 0xFF are used
+// as switches to Options.PrivateWindow (0xBF 0xBF is kept free for the 0xBF 0xBF 0xBF sync sequence)
+const markerPrivate = 0xBF
+const markerPrivateLow = 0xC0
+
 const offsInitAux = 0x00C0
 
 // The subrange of the previous (auxiliary) alphabet is coded via 0b11000000.
@@ -26,7 +37,7 @@ var auxOffset = map[int]int{
 	0x0380: 0x0391,      // Greek
 	0x0400: 0x0410,      // Cyrillic
 	0x0580: 0x05BE,      // Hebrew
-	0x0530: 0x0531,      // Armenian
+	0x0530: 0x0531,      // Armenian (never used, since offs is always a multiple of 0x80)
 	0x0600: 0x060B,      // Arabic
 	0x0900: 0x090D,      // Devangari
 	0x0980: 0x098F,      // Bengali
@@ -45,7 +56,7 @@ var auxOffset = map[int]int{
 	0x3000: 0x3040,      // Hiragana
 }
 
-// Hiragana and Katakana
+// Hiragana and Katakana, the only extra ranges that switch the current alphabet (others leave the state unchanged)
 var rangeHK = []int{0x3000, 0x3100}
 
 var rangesLatin = [][]int{
@@ -87,6 +98,30 @@ func decodeRanges(v int, ranges [][]int) int {
 	return -1
 }
 
+// extraDelta maps every 16 consecutive values of the reindexed extra ranges to the difference between their codepoints
+// and values (all extra ranges have sizes divisible by 16, so a chunk never spans two ranges)
+var extraDelta = extraDeltaTable(rangesExtra)
+
+func extraDeltaTable(ranges [][]int) []int {
+	delta := []int{}
+	v := 0
+	for _, rng := range ranges {
+		for cp := rng[0]; cp < rng[1]; cp += 0x10 {
+			delta = append(delta, rng[0]-v)
+		}
+		v += rng[1] - rng[0]
+	}
+	return delta
+}
+
+// decodeExtra is the same as decodeRanges(v, rangesExtra), but uses a lookup in extraDelta instead of scanning ranges
+func decodeExtra(v int) int {
+	if v < 0 || v>>4 >= len(extraDelta) {
+		return -1
+	}
+	return v + extraDelta[v>>4]
+}
+
 func getAuxOffset(offs int) int {
 	if remappedOffs, ok := auxOffset[offs]; ok {
 		return remappedOffs
@@ -94,124 +129,734 @@ func getAuxOffset(offs int) int {
 	return offs
 }
 
+// appendRune appends UTF-8 encoding of a codepoint to buf
+func appendRune(buf []byte, cp int) []byte {
+	tmp := [utf8.UTFMax]byte{}
+	return append(buf, tmp[:utf8.EncodeRune(tmp[:], rune(cp))]...)
+}
+
+// normalizeRune replaces invalid codepoints with U+FFFD
+func normalizeRune(cp int) int {
+	if !utf8.ValidRune(rune(cp)) {
+		return utf8.RuneError
+	}
+	return cp
+}
+
+func isASCII(str string) bool {
+	for i := 0; i < len(str); i++ {
+		if str[i] >= 0x80 {
+			return false
+		}
+	}
+	return true
+}
+
+// state describes the currently selected alphabets.
+// `offs` is the start of the currently active window of Unicode codepoints.
+// `auxOffs` allows encoding 64 codepoints of the auxiliary alphabet.
+// `is21Bit` is true if we're in 21-bit mode (2-3 bytes per character).
+type state struct {
+	offs    int
+	auxOffs int
+	is21Bit bool
+}
+
+func initStateV1() state {
+	return state{offs: 0, auxOffs: offsInitAux, is21Bit: false}
+}
+
+// inCurrent reports whether cp is in the current alphabet (which is 13-bit or 21-bit depending on is21Bit)
+func (st *state) inCurrent(cp int) bool {
+	if st.is21Bit {
+		return st.inCurrent21Bit(cp)
+	}
+	return cp&offsMask13Bit == st.offs
+}
+
+// inCurrent21Bit reports whether cp is in the current 21-bit alphabet
+func (st *state) inCurrent21Bit(cp int) bool {
+	return st.is21Bit && cp >= min21BitCp && (cp-min21BitCp)&offsMask21Bit == st.offs
+}
+
+// encodeRuneV1 appends the encoding of a single character to buf and updates the state.
+// When a character can be encoded in several ways, the first applicable one is used, in this order:
+//  1. Latin auxiliary alphabet (if auxOffs is 0),
+//  2. non-Latin auxiliary alphabet,
+//  3. current 13-bit alphabet (for extra ranges),
+//  4. extra ranges (except for Hiragana and Katakana in the current 21-bit alphabet with MinimizeSwitches),
+//  5. current 21-bit alphabet,
+//  6. switch to a 21-bit alphabet,
+//  7. current 13-bit alphabet,
+//  8. switch to a 13-bit alphabet.
+//
+// Steps 5-6 are used for codepoints from min21BitCp, and 7-8 for the rest.
+// With Options.PrivateWindow, its alphabet and the switch to it are checked between steps 2 and 3.
+func (st *state) encodeRuneV1(buf []byte, cp int, opts *Options) []byte {
+	st.assertValid(opts)
+	// First, check if we can use 1-byte encoding via small 6-bit auxiliary alphabet
+	if st.auxOffs == 0 && inRanges(cp, opts.latinAux()) {
+		// 1 byte: auxiliary alphabet is Latin, rearrange it to fit 0xC0-0xFF range
+		return append(buf, byte(markerAux|encodeRanges(cp, opts.latinAux())))
+	} else if st.auxOffs != 0 && cp >= st.auxOffs && cp <= st.auxOffs+0x3F {
+		// 1 byte: code point is within the auxiliary alphabet (non-Latin)
+		return append(buf, byte(markerAux|(cp-st.auxOffs)))
+	} else if opts.PrivateWindow != 0 && !st.is21Bit && st.offs == opts.PrivateWindow&offsMask13Bit && cp&offsMask13Bit == st.offs {
+		// 1 byte: code point is within the alphabet of the private window
+		return append(buf, byte(cp&0x7F))
+	} else if opts.PrivateWindow != 0 && cp >= opts.PrivateWindow && cp < opts.PrivateWindow+0x40 {
+		// 2 bytes: switch to the alphabet of the private window via codes not used by extra ranges
+		st.auxOffs = opts.auxOffset(st.offs)
+		st.offs = opts.PrivateWindow & offsMask13Bit
+		st.is21Bit = false
+		return append(buf, markerPrivate, byte(markerPrivateLow|(cp-opts.PrivateWindow)))
+	} else
+	// Second, there're 6 extra ranges (Hiragana, Katakana, and Emojis) that normally would require 3 bytes/character,
+	// but are encoded with 2 (using range of codepoints 0x10FFFF-0x1FFFFF, which are not covered by Unicode).
+	// With SimpleAstral option only the first one (below min21BitCp) is used, since those characters have no other encoding.
+	if inRanges(cp, rangesExtra) && !(opts.SimpleAstral && cp >= min21BitCp) && !(opts.MinimizeSwitches && st.inCurrent21Bit(cp)) {
+		newOffs := cp & offsMask13Bit
+		if !st.is21Bit && newOffs == st.offs { // 1 byte: code point is within the current alphabet
+			return append(buf, byte(cp&0x7F))
+		}
+		// Reindex 6 ranges into a single contiguous one
+		extra := encodeRanges(cp, rangesExtra)
+		buf = append(buf, byte(markerExtra|(1+(extra>>8))), byte(extra))
+		if opts.switchesOnExtra(cp) { // Only Hiragana and Katakana change the current alphabet (unless DenseEmoji is set)
+			st.auxOffs = opts.auxOffset(st.offs)
+			st.offs = newOffs
+			st.is21Bit = false
+		}
+		return buf
+	} else
+	// Lastly, check codepoint size to determine if it needs short (13-bit) or long (21-bit) mode
+	if cp >= min21BitCp {
+		// This code point requires 21 bit to encode
+		// Characters up to 0x2800 can be encoded in shorter forms, so we start from 0
+		cp -= min21BitCp
+		newOffs := cp & offsMask21Bit
+		if st.is21Bit && newOffs == st.offs { // 2 bytes: code point is within the current alphabet
+			return append(buf, byte((cp>>8)&0x7F), byte(cp))
+		}
+		// 3 bytes: we need to switch to the new alphabet.
+		// Unlike other switches, offs is stored as is, without remapping via auxOffset (and if the previous alphabet
+		// was a 21-bit one, its offset is treated as a codepoint). This is a part of the format, the decoder does the same.
+		st.auxOffs = st.offs
+		st.offs = newOffs
+		st.is21Bit = true
+		return append(buf, byte(marker21Bit|(cp>>16)), byte(cp>>8), byte(cp))
+	}
+	// This code point requires max 13 bits to encode
+	newOffs := cp & offsMask13Bit
+	if !st.is21Bit && newOffs == st.offs { // 1 byte: code point is within the current alphabet
+		return append(buf, byte(cp&0x7F))
+	}
+	// Final case: we need 2 bytes for this character
+	st.auxOffs = opts.auxOffset(st.offs)
+	if cp <= maxLatinCp {
+		st.offs = 0
+	} else {
+		st.offs = newOffs
+	}
+	st.is21Bit = false
+	return append(buf, byte(marker13Bit|(cp>>8)), byte(cp&0xFF))
+}
+
 // Encode converts string to an UTF-C byte array
 func Encode(str string) []byte {
-	// `offs`, `auxOffs` and `is21Bit` describe the current state.
-	// `offs` is the start of the currently active window of Unicode codepoints.
-	// `auxOffs` allows encoding 64 codepoints of the auxiliary alphabet.
-	// `is21Bit` is true if we're in 21-bit mode (2-3 bytes per character).
-	offs := 0
-	auxOffs := offsInitAux
-	is21Bit := false
-	buf := []byte{}
-	for _, ch := range str {
-		cp := int(ch)
-		// First, check if we can use 1-byte encoding via small 6-bit auxiliary alphabet
-		if auxOffs == 0 && inRanges(cp, rangesLatin) {
-			// 1 byte: auxiliary alphabet is Latin, rearrange it to fit 0xC0-0xFF range
-			buf = append(buf, byte(markerAux|encodeRanges(cp, rangesLatin)))
-		} else if auxOffs != 0 && cp >= auxOffs && cp <= auxOffs+0x3F {
-			// 1 byte: code point is within the auxiliary alphabet (non-Latin)
-			buf = append(buf, byte(markerAux|(cp-auxOffs)))
-		} else
-		// Second, there're 6 extra ranges (Hiragana, Katakana, and Emojis) that normally would require 3 bytes/character,
-		// but are encoded with 2 (using range of codepoints 0x10FFFF-0x1FFFFF, which are not covered by Unicode)
-		if inRanges(cp, rangesExtra) {
-			newOffs := cp & offsMask13Bit
-			if !is21Bit && newOffs == offs { // 1 byte: code point is within the current alphabet
-				buf = append(buf, byte(cp&0x7F))
-			} else {
-				// Reindex 6 ranges into a single contiguous one
-				extra := encodeRanges(cp, rangesExtra)
-				buf = append(buf, byte(markerExtra|(1+(extra>>8))), byte(extra))
-				if cp >= rangeHK[0] && cp < rangeHK[1] { // Only Hiragana and Katakana change the current alphabet
-					auxOffs = getAuxOffset(offs)
-					offs = newOffs
-					is21Bit = false
-				}
-			}
-		} else
-		// Lastly, check codepoint size to determine if it needs short (13-bit) or long (21-bit) mode
-		if cp >= min21BitCp {
-			// This code point requires 21 bit to encode
-			// Characters up to 0x2800 can be encoded in shorter forms, so we start from 0
-			cp -= min21BitCp
-			newOffs := cp & offsMask21Bit
-			if is21Bit && newOffs == offs { // 2 bytes: code point is within the current alphabet
-				buf = append(buf, byte((cp>>8)&0x7F), byte(cp))
-			} else { // 3 bytes: we need to switch to the new alphabet
-				buf = append(buf, byte(marker21Bit|(cp>>16)), byte(cp>>8), byte(cp))
-				auxOffs = offs
-				offs = newOffs
-				is21Bit = true
-			}
-		} else { // This code point requires max 13 bits to encode
-			newOffs := cp & offsMask13Bit
-			if !is21Bit && newOffs == offs { // 1 byte: code point is within the current alphabet
-				buf = append(buf, byte(cp&0x7F))
-			} else { // Final case: we need 2 bytes for this character
-				buf = append(buf, byte(marker13Bit|(cp>>8)), byte(cp&0xFF))
-				auxOffs = getAuxOffset(offs)
-				if cp <= maxLatinCp {
-					offs = 0
-				} else {
-					offs = newOffs
-				}
-				is21Bit = false
-			}
+	// ASCII strings are represented in the same way in UTF-C, so we can skip the state machine entirely
+	if asciiAsIs(str) {
+		return []byte(str)
+	}
+	// Default options never produce errors
+	buf, _ := EncodeWith(str, Options{})
+	return buf
+}
+
+// AppendEncode appends UTF-C encoding of the string to dst and returns the extended buffer
+func AppendEncode(dst []byte, str string) []byte {
+	if asciiAsIs(str) {
+		return append(dst, str...)
+	}
+	buf, _ := encodeWith(dst, initState(), str, &Options{}, nil)
+	return buf
+}
+
+// EncodeConcat returns Encode of the concatenation of parts, without building the joined string.
+// Note that it generally differs from concatenating Encode of each part, since the state is kept across the parts.
+func EncodeConcat(parts ...string) []byte {
+	n := 0
+	for _, part := range parts {
+		n += len(part)
+	}
+	opts := Options{}
+	st := initState()
+	buf := make([]byte, 0, n)
+	for _, part := range parts {
+		for _, ch := range part {
+			buf = st.encodeRune(buf, int(ch), &opts)
 		}
 	}
 	return buf
 }
 
-// Decode converts UTF-C byte array to a string
+// EncodeWithLines converts string to an UTF-C byte array, same as Encode, and returns the offset in buf of each
+// line's start: lineStarts[0] is 0, followed by the offset after each encoded U+000A. Since the encoding is stateful,
+// decoding from an offset requires the state at it, which is the state returned by DecodeColumn(State{}, buf[:offset]).
+func EncodeWithLines(str string) (buf []byte, lineStarts []int) {
+	opts := Options{}
+	st := initState()
+	buf = make([]byte, 0, len(str))
+	lineStarts = []int{0}
+	for _, ch := range str {
+		buf = st.encodeRune(buf, int(ch), &opts)
+		if ch == '\n' {
+			lineStarts = append(lineStarts, len(buf))
+		}
+	}
+	return buf, lineStarts
+}
+
+// StringEncoder encodes many strings reusing one internal buffer, so it doesn't allocate once the buffer is large enough.
+// The zero value is ready to use. It's not safe for concurrent use.
+type StringEncoder struct {
+	buf []byte
+}
+
+// EncodeString converts string to an UTF-C byte array, same as Encode.
+// The returned slice is only valid until the next call to EncodeString; copy it if you need to keep it.
+func (e *StringEncoder) EncodeString(str string) []byte {
+	e.buf = AppendEncode(e.buf[:0], str)
+	return e.buf
+}
+
+// EncodeBatch encodes each string of strs, encoding repeated strings only once.
+// The results for equal strings share the same memory, so they must not be modified in place.
+// The returned error is currently always nil.
+func EncodeBatch(strs []string) ([][]byte, error) {
+	out := make([][]byte, len(strs))
+	cache := make(map[string][]byte)
+	var buf []byte // All unique encodings are stored in one buffer
+	for i, str := range strs {
+		if enc, ok := cache[str]; ok {
+			out[i] = enc
+			continue
+		}
+		start := len(buf)
+		buf = AppendEncode(buf, str)
+		out[i] = buf[start:len(buf):len(buf)]
+		cache[str] = out[i]
+	}
+	return out, nil
+}
+
+// ByteLen returns the length of str in UTF-8 bytes (the same as len(str)).
+// Compare it with EncodedLen to see how much space UTF-C saves.
+func ByteLen(str string) int {
+	return len(str)
+}
+
+// RuneLen returns the number of codepoints in str. Each invalid UTF-8 byte counts as one codepoint,
+// since Encode replaces it with U+FFFD.
+func RuneLen(str string) int {
+	return utf8.RuneCountInString(str)
+}
+
+// EncodedLen returns the length of Encode(str) without building the output
+func EncodedLen(str string) int {
+	if asciiAsIs(str) {
+		return len(str)
+	}
+	opts := Options{}
+	st := initState()
+	scratch := [3]byte{}
+	n := 0
+	for _, ch := range str {
+		n += len(st.encodeRune(scratch[:0], int(ch), &opts))
+	}
+	return n
+}
+
+// EncodeBounded encodes str like Encode, but stops as soon as the output would exceed maxBytes.
+// It returns the encoded prefix (which always ends at a character boundary), the number of characters in it,
+// and whether the whole string fits. Nothing past the first character that doesn't fit is encoded.
+func EncodeBounded(str string, maxBytes int) (buf []byte, runes int, fits bool) {
+	if asciiAsIs(str) {
+		if len(str) <= maxBytes {
+			return []byte(str), len(str), true
+		}
+		if maxBytes < 0 {
+			maxBytes = 0
+		}
+		return []byte(str[:maxBytes]), maxBytes, false
+	}
+	opts := Options{}
+	st := initState()
+	scratch := [3]byte{}
+	buf = []byte{}
+	for _, ch := range str {
+		seq := st.encodeRune(scratch[:0], int(ch), &opts)
+		if len(buf)+len(seq) > maxBytes {
+			return buf, runes, false
+		}
+		buf = append(buf, seq...)
+		runes++
+	}
+	return buf, runes, true
+}
+
+// EncodeEqual reports whether a and b have the same UTF-C encoding, stopping at the first difference.
+// For valid UTF-8 this is the same as a == b, since decoding restores the original string. Invalid bytes,
+// however, are encoded as U+FFFD, so "\x80" and "\uFFFD" are equal in this sense.
+func EncodeEqual(a, b string) bool {
+	opts := Options{}
+	stA, stB := initState(), initState()
+	bufA, bufB := [3]byte{}, [3]byte{}
+	i, j := 0, 0
+	for i < len(a) && j < len(b) {
+		chA, sizeA := utf8.DecodeRuneInString(a[i:])
+		chB, sizeB := utf8.DecodeRuneInString(b[j:])
+		i += sizeA
+		j += sizeB
+		// Both encoders are always in the same state here, so the sequences are aligned
+		if string(stA.encodeRune(bufA[:0], int(chA), &opts)) != string(stB.encodeRune(bufB[:0], int(chB), &opts)) {
+			return false
+		}
+	}
+	return i == len(a) && j == len(b)
+}
+
+// ErrTruncated is returned when the buffer ends in the middle of a multi-byte sequence
+var ErrTruncated = errors.New("utfc: truncated sequence")
+
+// ErrInvalid is returned when a sequence decodes to a value that is not a valid Unicode codepoint
+var ErrInvalid = errors.New("utfc: invalid codepoint")
+
+// DecodeError describes a malformed sequence found in UTF-C input
+type DecodeError struct {
+	Offset int   // Offset of the first byte of the malformed sequence
+	Err    error // ErrTruncated or ErrInvalid
+}
+
+func (e *DecodeError) Error() string {
+	return e.Err.Error() + " at offset " + strconv.Itoa(e.Offset)
+}
+
+func (e *DecodeError) Unwrap() error {
+	return e.Err
+}
+
+// Kind is the type of a sequence, determined by its first byte
+type Kind int
+
+const (
+	Inline Kind = iota // 0xxxxxxx: a character of the current alphabet (followed by one more byte in 21-bit mode)
+	Aux                // 11xxxxxx: a character of the auxiliary alphabet
+	Bits13             // 100xxxxx: a switch to a 13-bit alphabet, 2 bytes
+	Bits21             // 101xxxxx (except 1011xxxx with non-zero xxxx): a switch to a 21-bit alphabet, 3 bytes
+	Extra              // 1011xxxx with non-zero xxxx: a character from extra ranges, 2 bytes
+)
+
+// MarkerKind returns the kind of the sequence starting with byte b
+func MarkerKind(b byte) Kind {
+	if (b & markerAux) == markerAux {
+		return Aux
+	} else if (b&markerExtra) == markerExtra && (b^markerExtra) != 0 {
+		return Extra
+	} else if (b & marker21Bit) == marker21Bit {
+		return Bits21
+	} else if (b & marker13Bit) == marker13Bit {
+		return Bits13
+	}
+	return Inline
+}
+
+// decodeRuneV1 decodes a single character starting at buf[i] and updates the state.
+// It returns the decoded value and the length of its sequence.
+// The returned value is not guaranteed to be a valid codepoint, but no bytes past the end of buf are ever read.
+func (st *state) decodeRuneV1(buf []byte, i int, opts *Options) (int, int, error) {
+	st.assertValid(opts)
+	cp := int(buf[i])
+	switch MarkerKind(buf[i]) {
+	case Aux:
+		if st.auxOffs == 0 {
+			cp = decodeRanges(cp^markerAux, opts.latinAux())
+		} else {
+			cp = st.auxOffs + (cp ^ markerAux)
+		}
+		return cp, 1, nil
+	case Extra:
+		if i+1 >= len(buf) {
+			return 0, 0, ErrTruncated
+		}
+		if opts.PrivateWindow != 0 && cp == markerPrivate && buf[i+1] >= markerPrivateLow {
+			st.auxOffs = opts.auxOffset(st.offs)
+			st.offs = opts.PrivateWindow & offsMask13Bit
+			st.is21Bit = false
+			return opts.PrivateWindow + int(buf[i+1]^markerPrivateLow), 2, nil
+		}
+		cp = decodeExtra(((cp^markerExtra)-1)<<8 | int(buf[i+1]))
+		if opts.switchesOnExtra(cp) {
+			st.auxOffs = opts.auxOffset(st.offs)
+			st.offs = cp & offsMask13Bit
+			st.is21Bit = false
+		}
+		return cp, 2, nil
+	case Bits21:
+		if i+2 >= len(buf) {
+			return 0, 0, ErrTruncated
+		}
+		cp = ((cp^marker21Bit)<<16 | int(buf[i+1])<<8 | int(buf[i+2]))
+		st.auxOffs = st.offs // Not remapped, see encodeRune
+		st.offs = cp & offsMask21Bit
+		st.is21Bit = true
+		return cp + min21BitCp, 3, nil
+	case Bits13:
+		if i+1 >= len(buf) {
+			return 0, 0, ErrTruncated
+		}
+		cp = (cp^marker13Bit)<<8 | int(buf[i+1])
+		st.auxOffs = opts.auxOffset(st.offs)
+		if cp <= maxLatinCp {
+			st.offs = 0
+		} else {
+			st.offs = cp & offsMask13Bit
+		}
+		st.is21Bit = false
+		return cp, 2, nil
+	}
+	if st.is21Bit {
+		if i+1 >= len(buf) {
+			return 0, 0, ErrTruncated
+		}
+		return min21BitCp + (st.offs | cp<<8 | int(buf[i+1])), 2, nil
+	}
+	return st.offs | cp, 1, nil
+}
+
+// Decode converts UTF-C byte array to a string.
+// Invalid codepoints are replaced with U+FFFD, and a truncated sequence at the end of the buffer is ignored.
+// The result takes at most 4 bytes per byte of buf: every sequence decodes to a single character, and even 1-byte ones
+// can produce a 4-byte UTF-8 character (e.g. after "𝄞中" the auxiliary alphabet starts from U+18000).
 func Decode(buf []byte) string {
-	offs := 0
-	auxOffs := offsInitAux
-	is21Bit := false
-	str := ""
+	str, _ := DecodeUpTo(buf)
+	return str
+}
+
+// DecodeUpTo decodes all complete sequences from the start of buf (each call starts from the initial state).
+// It returns the decoded string and the number of bytes consumed: if buf ends with an incomplete sequence,
+// it's left unconsumed. Invalid codepoints are replaced with U+FFFD.
+func DecodeUpTo(buf []byte) (string, int) {
+	st := initState()
+	opts := Options{}
+	out := make([]byte, 0, len(buf))
+	i := 0
+	for i < len(buf) {
+		cp, n, err := st.decodeRune(buf, i, &opts)
+		if err != nil {
+			break
+		}
+		assertAdvance(i, n, len(buf))
+		i += n
+		out = appendRune(out, cp)
+	}
+	return string(out), i
+}
+
+// DecodeUntil decodes buf up to the first occurrence of sentinel, which is not included into the result.
+// It returns the decoded string, the number of bytes consumed (including the sentinel) and whether the sentinel was found.
+// If it wasn't, the result is the same as of DecodeUpTo.
+// To pack several records into one buffer, encode each one along with its sentinel: Encode(record + string(sentinel)).
+func DecodeUntil(buf []byte, sentinel rune) (str string, consumed int, found bool) {
+	st := initState()
+	opts := Options{}
+	out := make([]byte, 0, len(buf))
+	i := 0
+	for i < len(buf) {
+		cp, n, err := st.decodeRune(buf, i, &opts)
+		if err != nil {
+			break
+		}
+		i += n
+		if rune(cp) == sentinel {
+			return string(out), i, true
+		}
+		out = appendRune(out, cp)
+	}
+	return string(out), i, false
+}
+
+// DecodeWithOffsets decodes buf in the same way as Decode, but returns the characters as runes along with
+// the offsets: byteOffsets[k] is the index in buf of the first byte of the sequence encoding runes[k].
+func DecodeWithOffsets(buf []byte) (runes []rune, byteOffsets []int) {
+	st := initState()
+	opts := Options{}
 	i := 0
 	for i < len(buf) {
-		cp := int(buf[i])
+		cp, n, err := st.decodeRune(buf, i, &opts)
+		if err != nil {
+			break
+		}
+		runes = append(runes, rune(normalizeRune(cp)))
+		byteOffsets = append(byteOffsets, i)
+		i += n
+	}
+	return runes, byteOffsets
+}
+
+// DecodeRangesFunc decodes buf and calls fn for each character with the span buf[startByte:endByte] of its sequence.
+// It stops at the first error returned by fn and returns it; a *DecodeError is returned if buf is malformed
+// (fn is called for all characters before the malformed sequence).
+func DecodeRangesFunc(buf []byte, fn func(r rune, startByte, endByte int) error) error {
+	st := initState()
+	opts := Options{}
+	for i := 0; i < len(buf); {
+		cp, n, err := st.decodeRune(buf, i, &opts)
+		if err == nil && !utf8.ValidRune(rune(cp)) {
+			err = ErrInvalid
+		}
+		if err != nil {
+			return &DecodeError{Offset: i, Err: err}
+		}
+		if err := fn(rune(cp), i, i+n); err != nil {
+			return err
+		}
+		i += n
+	}
+	return nil
+}
+
+// ErrNotBoundary is returned by CharIndexAt if the offset is not at the start of a sequence
+var ErrNotBoundary = errors.New("utfc: offset is not on a sequence boundary")
+
+// CharIndexAt returns the index of the character whose sequence starts at buf[byteOffset].
+// byteOffset equal to len(buf) is allowed and gives the total number of characters.
+// It returns ErrNotBoundary if byteOffset is out of range or falls inside a sequence,
+// and a *DecodeError if buf is malformed before byteOffset.
+func CharIndexAt(buf []byte, byteOffset int) (int, error) {
+	if byteOffset < 0 || byteOffset > len(buf) {
+		return 0, ErrNotBoundary
+	}
+	st := initState()
+	opts := Options{}
+	i, k := 0, 0
+	for i < byteOffset {
+		cp, n, err := st.decodeRune(buf, i, &opts)
+		if err == nil && !utf8.ValidRune(rune(cp)) {
+			err = ErrInvalid
+		}
+		if err != nil {
+			return 0, &DecodeError{Offset: i, Err: err}
+		}
+		i += n
+		k++
+	}
+	if i != byteOffset {
+		return 0, ErrNotBoundary
+	}
+	return k, nil
+}
+
+// DecodeLast returns the last n characters of buf (or all of them, if there are fewer), returning a *DecodeError
+// if buf is malformed. Since the state depends on everything before, buf is scanned from the start, but without
+// building the output: the state is saved every n characters, and decoding resumes from the last snapshot
+// before the tail, so only up to 2n characters are actually decoded.
+func DecodeLast(buf []byte, n int) (string, error) {
+	if n <= 0 {
+		return "", nil
+	}
+	type snapshot struct {
+		st      state
+		i, rune int
+	}
+	opts := Options{}
+	st := initState()
+	prev, last := snapshot{st, 0, 0}, snapshot{st, 0, 0}
+	i, total := 0, 0
+	for i < len(buf) {
+		if total%n == 0 {
+			prev, last = last, snapshot{st, i, total}
+		}
+		cp, size, err := st.decodeRune(buf, i, &opts)
+		if err == nil && !utf8.ValidRune(rune(cp)) {
+			err = ErrInvalid
+		}
+		if err != nil {
+			return "", &DecodeError{Offset: i, Err: err}
+		}
+		i += size
+		total++
+	}
+	// The tail starts at most n characters before the end, so the previous snapshot is always early enough
+	from := total - n
+	start := last
+	if start.rune > from {
+		start = prev
+	}
+	st, i = start.st, start.i
+	out := make([]byte, 0, len(buf)-i)
+	for k := start.rune; i < len(buf); k++ {
+		cp, size, _ := st.decodeRune(buf, i, &opts)
+		if k >= from {
+			out = appendRune(out, cp)
+		}
+		i += size
+	}
+	return string(out), nil
+}
+
+// DecodeSafe converts UTF-C byte array to a string, returning a *DecodeError if the buffer is malformed.
+// In that case the string holds the text decoded before the error offset, i.e. Decode(buf[:err.Offset]).
+func DecodeSafe(buf []byte) (string, error) {
+	return DecodeWith(buf, Options{})
+}
+
+// Valid reports whether buf is a well-formed UTF-C byte array, i.e. whether DecodeSafe would succeed on it
+func Valid(buf []byte) bool {
+	// Bytes below 0x80 always encode a character on their own in the initial state, and nothing can change the state
+	// until a byte with the high bit set is met
+	i := 0
+	for formats[currentFormat].asciiAsIs && i < len(buf) && buf[i] < 0x80 {
 		i++
-		if (cp & markerAux) == markerAux {
-			if auxOffs == 0 {
-				cp = decodeRanges(cp^markerAux, rangesLatin)
-			} else {
-				cp = auxOffs + (cp ^ markerAux)
-			}
-		} else if (cp&markerExtra) == markerExtra && (cp^markerExtra) != 0 {
-			cp = decodeRanges(((cp^markerExtra)-1)<<8|int(buf[i]), rangesExtra)
-			i++
-			if cp >= rangeHK[0] && cp < rangeHK[1] {
-				auxOffs = getAuxOffset(offs)
-				offs = cp & offsMask13Bit
-				is21Bit = false
-			}
-		} else if (cp & marker21Bit) == marker21Bit {
-			cp = ((cp^marker21Bit)<<16 | int(buf[i])<<8 | int(buf[i+1]))
-			i += 2
-			auxOffs = offs
-			offs = cp & offsMask21Bit
-			is21Bit = true
-			cp += min21BitCp
-		} else if (cp & marker13Bit) == marker13Bit {
-			cp = (cp^marker13Bit)<<8 | int(buf[i])
-			i++
-			auxOffs = getAuxOffset(offs)
-			if cp <= maxLatinCp {
-				offs = 0
-			} else {
-				offs = cp & offsMask13Bit
-			}
-			is21Bit = false
-		} else if is21Bit {
-			cp = min21BitCp + (offs | cp<<8 | int(buf[i]))
-			i++
+	}
+	if i == len(buf) {
+		return true
+	}
+	st := initState()
+	opts := Options{}
+	for i < len(buf) {
+		cp, n, err := st.decodeRune(buf, i, &opts)
+		if err != nil || !utf8.ValidRune(rune(cp)) {
+			return false
+		}
+		i += n
+	}
+	return true
+}
+
+// LooksLikeUTFC heuristically reports whether buf holds UTF-C (rather than UTF-8) data: it must be valid UTF-C,
+// but not valid UTF-8. It can't be perfect: ASCII-only data is the same in both encodings (so false is returned,
+// and either decoder works), and some short non-ASCII UTF-C sequences happen to form valid UTF-8 too.
+func LooksLikeUTFC(buf []byte) bool {
+	return !utf8.Valid(buf) && Valid(buf)
+}
+
+// resync finds a plausible sequence boundary after a malformed sequence starting at buf[i].
+// UTF-C is not self-synchronizing, so this is only a heuristic. Complete sequences that decode to invalid
+// codepoints are skipped entirely, since their bytes obviously belong together; otherwise (e.g. for truncated
+// sequences) we advance byte by byte. This repeats until a sequence that fits into the buffer and decodes
+// to a valid codepoint.
+func resync(buf []byte, i int, st state, opts *Options) int {
+	j := i
+	for j < len(buf) {
+		next := st
+		cp, n, err := next.decodeRune(buf, j, opts)
+		if err != nil {
+			n = 1
+		} else if j > i && utf8.ValidRune(rune(cp)) {
+			break
+		}
+		j += n
+	}
+	return j
+}
+
+// DecodeLenient converts UTF-C byte array to a string, replacing each malformed region with U+FFFD
+// (see resync for the details of recovery). It also returns the indices of runes in the resulting string
+// that were inserted in place of malformed data.
+func DecodeLenient(buf []byte) (string, []int) {
+	opts := Options{}
+	st := initState()
+	out := make([]byte, 0, len(buf))
+	var replaced []int
+	runes := 0
+	i := 0
+	for i < len(buf) {
+		next := st
+		cp, n, err := next.decodeRune(buf, i, &opts)
+		if err != nil || !utf8.ValidRune(rune(cp)) {
+			// Skip the malformed region, keeping the state unchanged
+			replaced = append(replaced, runes)
+			cp, n = utf8.RuneError, resync(buf, i, st, &opts)-i
 		} else {
-			cp = offs | cp
+			st = next
 		}
-		str += string(rune(cp))
+		i += n
+		out = appendRune(out, cp)
+		runes++
 	}
-	return str
+	return string(out), replaced
+}
+
+// Hole is an element of DecodeWithHoles result standing for an occurrence of the hole marker
+type Hole struct{}
+
+// DecodeWithHoles decodes buf the same way Decode does and splits the result at each occurrence of holeMarker.
+// The returned slice holds non-empty strings and a Hole for every marker, in order of appearance
+// (so adjacent markers give adjacent Holes). Text is reserved for holes by encoding holeMarker in its place,
+// which is usually one of private use characters (e.g. U+E000), taking 2 or 3 bytes.
+func DecodeWithHoles(buf []byte, holeMarker rune) []interface{} {
+	var segments []interface{}
+	str := Decode(buf)
+	start := 0
+	for i, ch := range str {
+		if ch != holeMarker {
+			continue
+		}
+		if i > start {
+			segments = append(segments, str[start:i])
+		}
+		segments = append(segments, Hole{})
+		start = i + utf8.RuneLen(ch)
+	}
+	if start < len(str) {
+		segments = append(segments, str[start:])
+	}
+	return segments
+}
+
+// Recovered is a part of the data decoded by DecodeRecover: either decoded text or malformed bytes
+type Recovered struct {
+	Malformed bool   // Whether the part is a malformed region
+	Text      string // Decoded text of a well-formed part
+	Data      []byte // Bytes of a malformed region
+}
+
+// DecodeRecover decodes buf the same way DecodeLenient does, but instead of replacing malformed regions with U+FFFD
+// it returns their bytes, so that the damaged data can be inspected. Decoded text alternates with malformed regions
+// (adjacent ones are merged), and Data of malformed parts refers to buf.
+func DecodeRecover(buf []byte) []Recovered {
+	opts := Options{}
+	st := initState()
+	var parts []Recovered
+	out := make([]byte, 0, len(buf))
+	i, raw := 0, -1 // raw is the start of the current malformed region or -1
+	for i < len(buf) {
+		next := st
+		cp, n, err := next.decodeRune(buf, i, &opts)
+		if err != nil || !utf8.ValidRune(rune(cp)) {
+			if raw < 0 {
+				if len(out) > 0 {
+					parts = append(parts, Recovered{Text: string(out)})
+					out = out[:0]
+				}
+				raw = i
+			}
+			i = resync(buf, i, st, &opts)
+			continue
+		}
+		if raw >= 0 {
+			parts = append(parts, Recovered{Malformed: true, Data: buf[raw:i]})
+			raw = -1
+		}
+		st = next
+		i += n
+		out = appendRune(out, cp)
+	}
+	if raw >= 0 {
+		parts = append(parts, Recovered{Malformed: true, Data: buf[raw:]})
+	} else if len(out) > 0 {
+		parts = append(parts, Recovered{Text: string(out)})
+	}
+	return parts
 }
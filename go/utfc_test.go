@@ -1,8 +1,14 @@
 package utfc
 
 import (
+	"bytes"
+	"errors"
+	"fmt"
+	"math/rand"
 	"strconv"
+	"strings"
 	"testing"
+	"unicode/utf8"
 )
 
 var testStrings []string = []string{
@@ -82,3 +88,2023 @@ func TestUTFC(t *testing.T) {
 		})
 	}
 }
+
+func decodeNoPanic(t *testing.T, buf []byte) {
+	defer func() {
+		if r := recover(); r != nil {
+			t.Fatalf("DecodeSafe panicked on %v: %v", hexString(buf), r)
+		}
+	}()
+	DecodeSafe(buf)
+	Decode(buf)
+}
+
+func TestDecodeNoPanic(t *testing.T) {
+	buf := make([]byte, 3)
+	for i := 0; i < 1<<16; i++ {
+		buf[0], buf[1] = byte(i>>8), byte(i)
+		decodeNoPanic(t, buf[:1])
+		decodeNoPanic(t, buf[:2])
+	}
+	if testing.Short() {
+		return
+	}
+	for i := 0; i < 1<<24; i++ {
+		buf[0], buf[1], buf[2] = byte(i>>16), byte(i>>8), byte(i)
+		decodeNoPanic(t, buf)
+	}
+}
+
+func TestDecodeSafeErrors(t *testing.T) {
+	for _, test := range testStrings {
+		buf := Encode(test)
+		if str, err := DecodeSafe(buf); err != nil || str != test {
+			t.Errorf("DecodeSafe failed on '%v': %v", test, err)
+		}
+	}
+
+	_, err := DecodeSafe([]byte{'a', marker21Bit, 0x00})
+	var derr *DecodeError
+	if !errors.As(err, &derr) || derr.Err != ErrTruncated || derr.Offset != 1 {
+		t.Errorf("Expected truncation error at offset 1, got %v", err)
+	}
+	if _, err := DecodeSafe([]byte{0xBF, 0xFF}); !errors.Is(err, ErrInvalid) {
+		t.Errorf("Expected invalid codepoint error, got %v", err)
+	}
+	if _, err := DecodeSafe([]byte{0xBF, 0xFF, 0xFF}); !errors.Is(err, ErrInvalid) {
+		t.Errorf("Expected invalid codepoint error, got %v", err)
+	}
+
+	// The text decoded before the error is returned as well
+	for _, test := range testStrings {
+		valid := Encode(test)
+		for _, tail := range [][]byte{{marker21Bit, 0x00}, {0xBF, 0xFF}} {
+			buf := append(valid[:len(valid):len(valid)], tail...)
+			str, err := DecodeSafe(buf)
+			if !errors.As(err, &derr) || derr.Offset != len(valid) || str != test {
+				t.Errorf("Corrupted '%v' decoded as '%v' (%v)", test, str, err)
+			}
+		}
+	}
+	if str, err := DecodeSafe([]byte{'a', 0x84, 0x1C, 0xBF, 0xFF, 'b'}); err == nil || str != "aМ" {
+		t.Errorf("Expected the prefix before the corruption, got '%v' (%v)", str, err)
+	}
+}
+
+func TestEncodeASCIIFastPath(t *testing.T) {
+	for _, test := range []string{"", "a", "Hello World!", "{\"key\": [1, 2, 3]}", "\x00\x01\t\n\x7F"} {
+		ctrl, _ := EncodeWith(test, Options{})
+		if buf := Encode(test); !bytes.Equal(buf, ctrl) {
+			t.Errorf("String '%v' encoded as %v, expected %v", test, hexString(buf), hexString(ctrl))
+		}
+	}
+}
+
+func TestEncodeAllocs(t *testing.T) {
+	// The output buffer is allocated once with the size of the input, which is enough for valid UTF-8
+	for _, test := range testStrings {
+		if allocs := testing.AllocsPerRun(10, func() { Encode(test) }); allocs > 1 {
+			t.Errorf("Encode of '%v' allocated %v times", test, allocs)
+		}
+	}
+}
+
+func BenchmarkEncode(b *testing.B) {
+	str := testStrings[39]
+	b.ReportAllocs()
+	b.SetBytes(int64(len(str)))
+	for i := 0; i < b.N; i++ {
+		Encode(str)
+	}
+	if allocs := testing.AllocsPerRun(10, func() { Encode(str) }); allocs > 1 {
+		b.Errorf("Encode allocated %v times per call", allocs)
+	}
+}
+
+func BenchmarkEncodeASCII(b *testing.B) {
+	str := "The quick brown fox jumps over the lazy dog, {\"key\": \"value\", \"id\": 42}"
+	for i := 0; i < b.N; i++ {
+		Encode(str)
+	}
+}
+
+// Hand-computed vectors documenting the wire format
+var testVectors = []struct {
+	str string
+	buf []byte
+}{
+	// ASCII is encoded as is
+	{"a", []byte{0x61}},
+	// Initial auxiliary alphabet is U+00C0-U+00FF: 0b11000000 | (0xE9 - 0xC0)
+	{"é", []byte{0xE9}},
+	// Switch to Cyrillic alphabet (0x0400) via 0b100xxxxx, then 1 byte per character
+	{"Мир", []byte{0x84, 0x1C, 0x38, 0x40}},
+	// Hiragana is encoded via the extra ranges and switches alphabet; after the switch to the next window
+	// the previous one (remapped to U+3040-U+307F) becomes auxiliary
+	{"ひらがな", []byte{0xB9, 0x72, 0xB9, 0x89, 0xCC, 0xEA}},
+	// Emoji from the extra ranges: 0x800 + 0x100 + 0x10 + 0x90 + (0x1F525 - 0x1F300) = 0xBC5
+	{"🔥", []byte{0xBC, 0xC5}},
+	// After switching from Latin to Cyrillic, Latin becomes the auxiliary alphabet (digits are at 0xF4-0xFD)
+	{"abcМир123", []byte{0x61, 0x62, 0x63, 0x84, 0x1C, 0x38, 0x40, 0xF5, 0xF6, 0xF7}},
+}
+
+func TestVectors(t *testing.T) {
+	for _, test := range testVectors {
+		if buf := Encode(test.str); !bytes.Equal(buf, test.buf) {
+			t.Errorf("String '%v' encoded as %v, expected %v", test.str, hexString(buf), hexString(test.buf))
+		}
+		if str := Decode(test.buf); str != test.str {
+			t.Errorf("Bytes %v decoded as '%v', expected '%v'", hexString(test.buf), str, test.str)
+		}
+	}
+}
+
+func TestDecodeLenient(t *testing.T) {
+	for _, test := range testStrings {
+		if str, replaced := DecodeLenient(Encode(test)); str != test || len(replaced) != 0 {
+			t.Errorf("String '%v' decoded back as '%v', replaced: %v", test, str, replaced)
+		}
+	}
+
+	for _, test := range []struct {
+		buf      []byte
+		str      string
+		replaced []int
+	}{
+		// Complete sequences with invalid values are skipped entirely
+		{[]byte{'a', 0xBF, 0xFF, 'b'}, "a�b", []int{1}},
+		{[]byte{0x84, 0x1C, 0xBF, 0xFF, 0x38}, "М�и", []int{1}},
+		{[]byte{'a', 0xBF, 0xFF, 0xBF, 0xFF, 'b', 0xBF, 0xFF}, "a�b�", []int{1, 3}},
+		{[]byte{'a', 0xBF, 0xFF, 0xBF}, "a�", []int{1}},
+		// Truncated sequences are skipped byte by byte
+		{[]byte{'a', 'b', marker21Bit, 0x00}, "ab�\x00", []int{2}},
+	} {
+		str, replaced := DecodeLenient(test.buf)
+		if str != test.str || fmt.Sprint(replaced) != fmt.Sprint(test.replaced) {
+			t.Errorf("Bytes %v decoded as '%v' %v, expected '%v' %v", hexString(test.buf), str, replaced, test.str, test.replaced)
+		}
+	}
+
+	// Corruption in the middle of a stream doesn't affect the tail
+	head, tail := "Привет, ", "мир! 日本語"
+	buf := append(Encode(head), 0xBF, 0xF0, 0xBF, 0xE0)
+	st := initState()
+	for _, ch := range head {
+		st.encodeRune(nil, int(ch), &Options{})
+	}
+	for _, ch := range tail {
+		buf = st.encodeRune(buf, int(ch), &Options{})
+	}
+	if str, replaced := DecodeLenient(buf); str != head+"�"+tail || len(replaced) != 1 {
+		t.Errorf("Corrupted stream decoded as '%v' %v", str, replaced)
+	}
+}
+
+func TestEncodedLen(t *testing.T) {
+	for _, test := range testStrings {
+		if n, expected := EncodedLen(test), len(Encode(test)); n != expected {
+			t.Errorf("String '%v' has encoded length %v, expected %v", test, n, expected)
+		}
+	}
+}
+
+func TestLongSingleScriptRun(t *testing.T) {
+	// Lowercase Cyrillic letters (U+0430-U+044F) are within a single alphabet,
+	// so only the first one requires a switch
+	const n = 1000000
+	runes := make([]rune, n)
+	for i := range runes {
+		runes[i] = rune(0x0430 + i%32)
+	}
+	if size := EncodedLen(string(runes)); size != n+1 {
+		t.Errorf("Encoded length of %v characters is %v, expected %v", n, size, n+1)
+	}
+
+	// Full Cyrillic block spans two alphabets (U+0400-U+047F and U+0480-U+04FF).
+	// Each crossing costs a switch, but the previous alphabet becomes auxiliary: characters within its
+	// 64-codepoint window (U+0410-U+044F for the first one) are still encoded in 1 byte.
+	str := "абвг" + string(rune(0x0490)) + "абвг" + string(rune(0x0491)) + "абвг"
+	if size, expected := EncodedLen(str), 2+3+2+4+1+4; size != expected {
+		t.Errorf("Encoded length of '%v' is %v, expected %v", str, size, expected)
+	}
+}
+
+func TestDecodeUpTo(t *testing.T) {
+	for _, test := range []struct {
+		buf      []byte
+		str      string
+		consumed int
+	}{
+		{[]byte{}, "", 0},
+		{Encode("Мир"), "Мир", 4},
+		{[]byte{'a', 0x84}, "a", 1},
+		{[]byte{'a', 0x84, 0x1C, 0xBC}, "aМ", 3},
+		{[]byte{'a', marker21Bit, 0x01}, "a", 1},
+		// Inline characters take 2 bytes in 21-bit mode
+		{[]byte{marker21Bit, 0x01, 0x02, 0x03}, "\u2902", 3},
+	} {
+		if str, consumed := DecodeUpTo(test.buf); str != test.str || consumed != test.consumed {
+			t.Errorf("Bytes %v decoded as '%v' (%v consumed), expected '%v' (%v consumed)", hexString(test.buf), str, consumed, test.str, test.consumed)
+		}
+	}
+}
+
+func TestDecodeUntil(t *testing.T) {
+	// Records are packed with their sentinels, each encoded from the initial state
+	records := []string{"Привет", "", "世界", "abc"}
+	var buf []byte
+	for _, record := range records {
+		buf = append(buf, Encode(record+"\x00")...)
+	}
+	for i := 0; len(buf) > 0; i++ {
+		str, consumed, found := DecodeUntil(buf, 0)
+		if !found || i >= len(records) || str != records[i] {
+			t.Fatalf("Record %v decoded as '%v' (found: %v)", i, str, found)
+		}
+		buf = buf[consumed:]
+	}
+
+	for _, test := range []struct {
+		buf      []byte
+		sentinel rune
+		str      string
+		consumed int
+		found    bool
+	}{
+		{[]byte{}, 0, "", 0, false},
+		{Encode("ab|cd"), '|', "ab", 3, true},
+		{Encode("Мир|"), '|', "Мир", 6, true},
+		{Encode("Мир"), '|', "Мир", 4, false},
+		{Encode("Мир—мир"), '—', "Мир", 6, true},
+		// Truncated tail is not consumed
+		{[]byte{'a', 0x84}, '|', "a", 1, false},
+	} {
+		str, consumed, found := DecodeUntil(test.buf, test.sentinel)
+		if str != test.str || consumed != test.consumed || found != test.found {
+			t.Errorf("Bytes %v decoded as '%v' (%v, %v), expected '%v' (%v, %v)", hexString(test.buf), str, consumed, found, test.str, test.consumed, test.found)
+		}
+	}
+}
+
+func TestDecodeWithOffsets(t *testing.T) {
+	opts := Options{}
+	for _, test := range testStrings {
+		buf := Encode(test)
+		runes, offsets := DecodeWithOffsets(buf)
+		if string(runes) != test || len(offsets) != len(runes) {
+			t.Errorf("String '%v' decoded back as '%v' with %v offsets", test, string(runes), len(offsets))
+			continue
+		}
+		// Encoding each rune separately must produce exactly the bytes between the offsets
+		st := initState()
+		for k, ch := range runes {
+			end := len(buf)
+			if k+1 < len(offsets) {
+				end = offsets[k+1]
+			}
+			if seq := st.encodeRune(nil, int(ch), &opts); !bytes.Equal(seq, buf[offsets[k]:end]) {
+				t.Errorf("String '%v': rune %v at offset %v is %v, expected %v", test, k, offsets[k], hexString(buf[offsets[k]:end]), hexString(seq))
+				break
+			}
+		}
+	}
+
+	runes, offsets := DecodeWithOffsets([]byte{'a', 0x84, 0x1C, marker21Bit, 0x01})
+	if string(runes) != "aМ" || fmt.Sprint(offsets) != "[0 1]" {
+		t.Errorf("Truncated buffer decoded as '%v' with offsets %v", string(runes), offsets)
+	}
+}
+
+func TestLeadingSwitch(t *testing.T) {
+	// The first switch costs a single byte on top of the character itself, which is as much as
+	// a header with the initial alphabet would take
+	tests := []struct {
+		str     string
+		perChar int
+	}{
+		{"П", 1},
+		{"Привет", 1},
+		{"שלום", 1},
+		{"中文字", 2},
+		{"한국어", 2},
+	}
+	for _, test := range tests {
+		expected := len([]rune(test.str))*test.perChar + 1
+		if buf := Encode(test.str); len(buf) != expected {
+			t.Errorf("String '%v' is encoded to %v bytes instead of %v", test.str, len(buf), expected)
+		}
+	}
+}
+
+func TestDecodeWithHoles(t *testing.T) {
+	const hole = '\uE000'
+	for _, test := range []struct {
+		str      string
+		expected string
+	}{
+		{"", ""},
+		{"Привет, мир!", "Привет, мир!"},
+		{"Hello \uE000 world", "Hello |_| world"},
+		{"\uE000Привет\uE000\uE000мир 日本語\uE000", "_|Привет|_|_|мир 日本語|_"},
+		{"\uE000", "_"},
+	} {
+		segments := DecodeWithHoles(Encode(test.str), hole)
+		parts := make([]string, len(segments))
+		for i, seg := range segments {
+			switch seg := seg.(type) {
+			case string:
+				parts[i] = seg
+			case Hole:
+				parts[i] = "_"
+			default:
+				t.Fatalf("Unexpected segment %#v", seg)
+			}
+		}
+		if ctrl := strings.Join(parts, "|"); ctrl != test.expected {
+			t.Errorf("String %+q decoded as %+q, expected %+q", test.str, ctrl, test.expected)
+		}
+	}
+}
+
+func TestDecodeRecover(t *testing.T) {
+	format := func(parts []Recovered) string {
+		strs := make([]string, len(parts))
+		for i, part := range parts {
+			if part.Malformed {
+				strs[i] = "[" + hexString(part.Data) + "]"
+			} else {
+				strs[i] = part.Text
+			}
+		}
+		return strings.Join(strs, "|")
+	}
+	for _, test := range testStrings {
+		if parts := DecodeRecover(Encode(test)); format(parts) != test || len(parts) > 1 {
+			t.Errorf("String '%v' decoded back as %v", test, format(parts))
+		}
+	}
+
+	for _, test := range []struct {
+		buf      []byte
+		expected string
+	}{
+		{[]byte{'a', 0xBF, 0xFF, 'b'}, "a|[" + hexString([]byte{0xBF, 0xFF}) + "]|b"},
+		{[]byte{0x84, 0x1C, 0xBF, 0xFF, 0x38}, "М|[" + hexString([]byte{0xBF, 0xFF}) + "]|и"},
+		{[]byte{'a', 0xBF, 0xFF, 0xBF, 0xFF, 'b', 0xBF, 0xFF}, "a|[" + hexString([]byte{0xBF, 0xFF, 0xBF, 0xFF}) + "]|b|[" + hexString([]byte{0xBF, 0xFF}) + "]"},
+		{[]byte{0xBF, 0xFF, 'a'}, "[" + hexString([]byte{0xBF, 0xFF}) + "]|a"},
+		{[]byte{'a', 'b', marker21Bit, 0x00}, "ab|[" + hexString([]byte{marker21Bit}) + "]|\x00"},
+	} {
+		if parts := DecodeRecover(test.buf); format(parts) != test.expected {
+			t.Errorf("Bytes %v decoded as %v, expected %v", hexString(test.buf), format(parts), test.expected)
+		}
+	}
+
+	// The raw bytes of an embedded invalid region are preserved, and the tail is decoded after it
+	head, tail := "Привет, ", "мир! 日本語"
+	garbage := []byte{0xBF, 0xF0, 0xBF, 0xE0}
+	buf := append(Encode(head), garbage...)
+	st := initState()
+	for _, ch := range head {
+		st.encodeRune(nil, int(ch), &Options{})
+	}
+	for _, ch := range tail {
+		buf = st.encodeRune(buf, int(ch), &Options{})
+	}
+	parts := DecodeRecover(buf)
+	if len(parts) != 3 || parts[0].Text != head || !parts[1].Malformed || !bytes.Equal(parts[1].Data, garbage) || parts[2].Text != tail {
+		t.Errorf("Corrupted stream decoded as %v", format(parts))
+	}
+}
+
+func TestMaxExpansionRatio(t *testing.T) {
+	// Each sequence decodes to a single character, so Decode never takes more than 4 bytes of UTF-8 per byte.
+	// Search for the worst case of each kind of sequence in various states to make sure this bound is tight.
+	opts := Options{}
+	prefixes := []string{"", "a", "¿", "Ж", "Ж!", "\u1F80", "中", "𝄞", "𝄞中", "\U0010FFFF中", "ひ", "😀"}
+	worst := map[string][2]int{} // Kind of sequence -> maximal UTF-8 bytes and the length of the sequence
+	for _, prefix := range prefixes {
+		st := initState()
+		for _, ch := range prefix {
+			st.encodeRune(nil, int(ch), &opts)
+		}
+		for b0 := 0; b0 < 0x100; b0++ {
+			for _, b1 := range []byte{0x00, 0x7F, 0x80, 0xC0, 0xFF} {
+				for _, b2 := range []byte{0x00, 0xFF} {
+					next := st
+					cp, n, err := next.decodeRune([]byte{byte(b0), b1, b2}, 0, &opts)
+					if err != nil || !utf8.ValidRune(rune(cp)) {
+						continue
+					}
+					kind := "Base"
+					switch {
+					case b0&markerAux == markerAux:
+						kind = "Aux"
+					case b0 == markerPrivate:
+						kind = "Private"
+					case b0&0xF0 == markerExtra && b0&0x0F != 0:
+						kind = "Extra"
+					case b0&0xE0 == marker21Bit:
+						kind = "21-bit"
+					case b0&0xE0 == marker13Bit:
+						kind = "13-bit"
+					}
+					size := utf8.RuneLen(rune(cp))
+					if size > n*4 {
+						t.Fatalf("Sequence % x after '%v' takes %v bytes, but decodes to %v", []byte{byte(b0), b1, b2}[:n], prefix, n, size)
+					}
+					if w := worst[kind]; size*w[1] > w[0]*n || w[1] == 0 {
+						worst[kind] = [2]int{size, n}
+					}
+				}
+			}
+		}
+	}
+	for kind, expected := range map[string][2]int{"Base": {3, 1}, "Aux": {4, 1}, "Extra": {4, 2}, "13-bit": {3, 2}, "21-bit": {4, 3}} {
+		if worst[kind] != expected {
+			t.Errorf("Worst case for %v sequences is %v bytes of %v, expected %v of %v", kind, worst[kind][0], worst[kind][1], expected[0], expected[1])
+		}
+	}
+	// The bound also holds for malformed data and is reached for long strings
+	rnd := rand.New(rand.NewSource(1))
+	for k := 0; k < 1000; k++ {
+		buf := make([]byte, rnd.Intn(20))
+		rnd.Read(buf)
+		if str, _ := DecodeLenient(buf); len(Decode(buf)) > 4*len(buf) || len(str) > 4*len(buf) {
+			t.Fatalf("Bytes %v decoded to more than %v bytes", hexString(buf), 4*len(buf))
+		}
+	}
+	str := "𝄞中" + strings.Repeat("\U00018000", 1000)
+	if buf := Encode(str); len(buf) != 1006 || Decode(buf) != str {
+		t.Errorf("String of %v bytes is encoded to %v bytes", len(str), len(buf))
+	}
+}
+
+func TestEncodeWithLines(t *testing.T) {
+	lines := []string{"package main", "", "// Привет, мир!", "var s = \"日本語\" // ひらがな", "\tx := 'Ж' + 1 🔥", ""}
+	str := strings.Join(lines, "\n")
+	buf, lineStarts := EncodeWithLines(str)
+	if !bytes.Equal(buf, Encode(str)) {
+		t.Errorf("Text encoded as %v, expected %v", hexString(buf), hexString(Encode(str)))
+	}
+	if len(lineStarts) != len(lines) {
+		t.Fatalf("Expected %v lines, got %v: %v", len(lines), len(lineStarts), lineStarts)
+	}
+	for k, start := range lineStarts {
+		if prefix := Encode(strings.Join(lines[:k], "\n") + "\n"); k > 0 && start != len(prefix) {
+			t.Errorf("Line %v starts at %v, expected %v", k, start, len(prefix))
+		}
+		// Each line can be decoded from its start given the state at that point
+		end := len(buf)
+		if k+1 < len(lineStarts) {
+			end = lineStarts[k+1]
+		}
+		_, st := DecodeColumn(State{}, buf[:start])
+		if line, _ := DecodeColumn(st, buf[start:end]); strings.TrimSuffix(line, "\n") != lines[k] {
+			t.Errorf("Line %v decoded as %+q, expected %+q", k, line, lines[k])
+		}
+	}
+	if buf, lineStarts := EncodeWithLines(""); len(buf) != 0 || len(lineStarts) != 1 || lineStarts[0] != 0 {
+		t.Errorf("Empty string encoded as %v with lines %v", buf, lineStarts)
+	}
+}
+
+func TestDecodeRangesFunc(t *testing.T) {
+	for _, test := range testStrings {
+		buf := Encode(test)
+		runes, offsets := DecodeWithOffsets(buf)
+		k := 0
+		err := DecodeRangesFunc(buf, func(r rune, start, end int) error {
+			next := len(buf)
+			if k+1 < len(offsets) {
+				next = offsets[k+1]
+			}
+			if k >= len(runes) || r != runes[k] || start != offsets[k] || end != next {
+				t.Errorf("Character %v of '%v' is %+q at %v-%v", k, test, r, start, end)
+			}
+			k++
+			return nil
+		})
+		if err != nil || k != len(runes) {
+			t.Errorf("String '%v': %v of %v characters visited (%v)", test, k, len(runes), err)
+		}
+	}
+	// Stops at the first error of the callback
+	stop := errors.New("stop")
+	visited := 0
+	if err := DecodeRangesFunc(Encode("Привет"), func(r rune, start, end int) error {
+		visited++
+		if r == 'и' {
+			return stop
+		}
+		return nil
+	}); err != stop || visited != 3 {
+		t.Errorf("Expected to stop after 3 characters, got %v after %v", err, visited)
+	}
+	var decodeErr *DecodeError
+	visited = 0
+	if err := DecodeRangesFunc([]byte{'a', 'b', 0xBF, 0xFF}, func(r rune, start, end int) error {
+		visited++
+		return nil
+	}); !errors.As(err, &decodeErr) || decodeErr.Offset != 2 || visited != 2 {
+		t.Errorf("Expected ErrInvalid at offset 2 after 2 characters, got %v after %v", err, visited)
+	}
+}
+
+func TestCharIndexAt(t *testing.T) {
+	for _, test := range testStrings {
+		buf := Encode(test)
+		_, offsets := DecodeWithOffsets(buf)
+		for k, offs := range append(offsets, len(buf)) {
+			if idx, err := CharIndexAt(buf, offs); err != nil || idx != k {
+				t.Errorf("String '%v': offset %v gives index %v (%v), expected %v", test, offs, idx, err, k)
+				break
+			}
+		}
+	}
+
+	buf := Encode("aМир中文") // 61 84 1C 38 40 A0 26 2D 3D 87
+	for _, test := range []struct {
+		offs, idx int
+		err       error
+	}{
+		{0, 0, nil}, {1, 1, nil}, {3, 2, nil}, {5, 4, nil}, {8, 5, nil}, {10, 6, nil},
+		{2, 0, ErrNotBoundary}, {6, 0, ErrNotBoundary}, {9, 0, ErrNotBoundary},
+		{-1, 0, ErrNotBoundary}, {11, 0, ErrNotBoundary},
+	} {
+		if idx, err := CharIndexAt(buf, test.offs); err != test.err || idx != test.idx {
+			t.Errorf("Offset %v gives index %v (%v), expected %v (%v)", test.offs, idx, err, test.idx, test.err)
+		}
+	}
+	if _, err := CharIndexAt([]byte{'a', 0xBF, 0xFF, 'b'}, 3); !errors.Is(err, ErrInvalid) {
+		t.Errorf("Expected ErrInvalid, got %v", err)
+	}
+}
+
+var benchmarkScripts = map[string]string{
+	"ASCII":    strings.Repeat("The quick brown fox jumps over the lazy dog. ", 20),
+	"Cyrillic": testStrings[39],
+	"Japanese": testStrings[33],
+	"Chinese":  testStrings[37],
+	"Emoji":    strings.Repeat("🏴‍☠️🇬🇷❤️🔥😀👍", 50),
+}
+
+func decodeConcat(buf []byte) string {
+	st, opts := initState(), Options{}
+	str := ""
+	for i := 0; i < len(buf); {
+		cp, n, err := st.decodeRune(buf, i, &opts)
+		if err != nil {
+			break
+		}
+		i += n
+		str += string(rune(cp))
+	}
+	return str
+}
+
+func decodeBuilder(buf []byte) string {
+	st, opts := initState(), Options{}
+	var sb strings.Builder
+	for i := 0; i < len(buf); {
+		cp, n, err := st.decodeRune(buf, i, &opts)
+		if err != nil {
+			break
+		}
+		i += n
+		sb.WriteRune(rune(cp))
+	}
+	return sb.String()
+}
+
+func decodeBytes(buf []byte) string {
+	st, opts := initState(), Options{}
+	out := make([]byte, 0, len(buf))
+	for i := 0; i < len(buf); {
+		cp, n, err := st.decodeRune(buf, i, &opts)
+		if err != nil {
+			break
+		}
+		i += n
+		out = appendRune(out, cp)
+	}
+	return string(out)
+}
+
+// Compares ways of building the decoded string. Appending to a byte slice has the fewest allocations
+// and is the fastest or on par with the others (strings.Builder was marginally ahead for Cyrillic), so it's used by Decode.
+func BenchmarkDecodeStrategies(b *testing.B) {
+	for _, strategy := range []struct {
+		name   string
+		decode func([]byte) string
+	}{
+		{"Concat", decodeConcat},
+		{"Builder", decodeBuilder},
+		{"Bytes", decodeBytes},
+	} {
+		for _, script := range []string{"ASCII", "Cyrillic", "Japanese", "Chinese", "Emoji"} {
+			buf := Encode(benchmarkScripts[script])
+			if strategy.decode(buf) != benchmarkScripts[script] {
+				b.Fatalf("%v failed to decode %v", strategy.name, script)
+			}
+			b.Run(strategy.name+"/"+script, func(b *testing.B) {
+				b.ReportAllocs()
+				for i := 0; i < b.N; i++ {
+					strategy.decode(buf)
+				}
+			})
+		}
+	}
+}
+
+func TestDecodeExtra(t *testing.T) {
+	// Values that can follow markerExtra, including the ones past the end of extra ranges
+	for v := 0; v <= 0xEFF; v++ {
+		if cp, expected := decodeExtra(v), decodeRanges(v, rangesExtra); cp != expected {
+			t.Errorf("Value 0x%03X decoded as 0x%04X, expected 0x%04X", v, cp, expected)
+		}
+	}
+}
+
+func BenchmarkDecodeEmoji(b *testing.B) {
+	// Emojis from the last extra ranges, where locating the range takes the longest
+	for name, str := range map[string]string{"Reactions": reactions, "Faces": strings.Repeat("🤔🤣🥰🤷🧐🤯", 100), "Emoji": benchmarkScripts["Emoji"]} {
+		buf := Encode(str)
+		b.Run(name, func(b *testing.B) {
+			b.SetBytes(int64(len(buf)))
+			for i := 0; i < b.N; i++ {
+				Decode(buf)
+			}
+		})
+	}
+}
+
+func TestGlagoliticCoptic(t *testing.T) {
+	// Both blocks are within the first 21-bit alphabet (U+2800-U+A7FF), so after the initial 3-byte switch
+	// every character takes 2 bytes, even when switching between the two scripts
+	for _, block := range [][]int{{0x2C00, 0x2C60}, {0x2C80, 0x2D00}, {0x2C00, 0x2D00}} {
+		runes := []rune{}
+		for cp := block[0]; cp < block[1]; cp++ {
+			runes = append(runes, rune(cp))
+		}
+		str := string(runes)
+		buf := Encode(str)
+		if ctrl := Decode(buf); ctrl != str {
+			t.Errorf("Block %04X-%04X decoded back as '%v'", block[0], block[1], ctrl)
+		}
+		if expected := 3 + 2*(len(runes)-1); len(buf) != expected {
+			t.Errorf("Block %04X-%04X encoded in %v bytes, expected %v", block[0], block[1], len(buf), expected)
+		}
+	}
+}
+
+func TestByteRuneLen(t *testing.T) {
+	for _, test := range []struct {
+		str          string
+		bytes, runes int
+	}{
+		{"", 0, 0},
+		{"abc", 3, 3},
+		{"Мир", 6, 3},
+		{"日本語", 9, 3},
+		{"🔥", 4, 1},
+		{"a\x80b", 3, 3},
+	} {
+		if ByteLen(test.str) != test.bytes || RuneLen(test.str) != test.runes {
+			t.Errorf("String %+q has %v bytes and %v runes, expected %v and %v", test.str, ByteLen(test.str), RuneLen(test.str), test.bytes, test.runes)
+		}
+		// RuneLen is the number of characters after a round-trip
+		if runes, _ := DecodeWithOffsets(Encode(test.str)); len(runes) != test.runes {
+			t.Errorf("String %+q decodes to %v runes", test.str, len(runes))
+		}
+	}
+}
+
+func TestEncodeEqual(t *testing.T) {
+	for _, test := range []struct {
+		a, b  string
+		equal bool
+	}{
+		{"", "", true},
+		{"abc", "abc", true},
+		{"abc", "abd", false},
+		{"abc", "ab", false},
+		{"Мир", "Мир!", false},
+		{"日本語", "日本語", true},
+		{"\x80", "�", true},
+		{"a\xE2\x82b", "a��b", true},
+	} {
+		if equal := EncodeEqual(test.a, test.b); equal != test.equal {
+			t.Errorf("EncodeEqual('%v', '%v') = %v, expected %v", test.a, test.b, equal, test.equal)
+		}
+		if equal := bytes.Equal(Encode(test.a), Encode(test.b)); equal != test.equal {
+			t.Errorf("Encode('%v') == Encode('%v') is %v, expected %v", test.a, test.b, equal, test.equal)
+		}
+	}
+}
+
+func TestEncodeInjective(t *testing.T) {
+	// Encode is injective over valid UTF-8, since Decode(Encode(s)) == s. Check it on random strings
+	// built from a small alphabet mixing scripts, so that many of them share prefixes and states.
+	alphabet := []rune("a -1ÀéМиאב日か🔥⠀\U00012000")
+	rnd := rand.New(rand.NewSource(1))
+	seen := map[string]string{}
+	for i := 0; i < 20000; i++ {
+		runes := make([]rune, rnd.Intn(6))
+		for j := range runes {
+			runes[j] = alphabet[rnd.Intn(len(alphabet))]
+		}
+		str := string(runes)
+		buf := Encode(str)
+		if ctrl := Decode(buf); ctrl != str {
+			t.Fatalf("String '%v' decoded back as '%v'", str, ctrl)
+		}
+		if other, ok := seen[string(buf)]; ok && other != str {
+			t.Fatalf("Strings '%v' and '%v' have the same encoding %v", str, other, hexString(buf))
+		}
+		seen[string(buf)] = str
+	}
+}
+
+func TestCombiningMarks(t *testing.T) {
+	// Combining marks (U+0300-U+036F) don't need a separate option: the first mark switches
+	// the alphabet to U+0300-U+037F, while Latin becomes auxiliary, so both base letters and
+	// following marks take 1 byte. Latin punctuation switches back, but then marks
+	// U+0300-U+033F are in the auxiliary alphabet.
+	for _, test := range []struct {
+		str  string
+		size int
+	}{
+		{"re\u0301sume\u0301 cafe\u0301", 2 + 2 + 4 + 1 + 1 + 4 + 1},
+		{"e\u0301, e\u0301. e\u0301", 1 + 2 + 2 + 1 + 1 + 1 + 1 + 1 + 1 + 1},
+		{"Tie\u0302\u0301ng Vie\u0323\u0302t", 3 + 2 + 1 + 4 + 3 + 1 + 1},
+	} {
+		buf := Encode(test.str)
+		if ctrl := Decode(buf); ctrl != test.str {
+			t.Errorf("String '%v' decoded back as '%v'", test.str, ctrl)
+		}
+		if len(buf) != test.size {
+			t.Errorf("String '%v' encoded in %v bytes, expected %v: %v", test.str, len(buf), test.size, hexString(buf))
+		}
+	}
+}
+
+func BenchmarkEncodeCombining(b *testing.B) {
+	// Vietnamese text in decomposed form (NFD)
+	str := strings.Repeat("Tiếng Việt là ngôn ngữ của người Việt. ", 20)
+	b.ReportAllocs()
+	b.SetBytes(int64(len(str)))
+	for i := 0; i < b.N; i++ {
+		Encode(str)
+	}
+	b.ReportMetric(float64(EncodedLen(str))/float64(len([]rune(str))), "bytes/char")
+}
+
+func TestCJK(t *testing.T) {
+	// All of CJK Unified Ideographs are within the first 21-bit alphabet (U+2800-U+A7FF), so there's
+	// no switching between 128-character windows: after the initial 3-byte switch each ideograph takes 2 bytes
+	// (2/3 of UTF-8 size). A wider CJK-specific window would not improve this, the remaining overhead in
+	// real text comes from Latin characters and punctuation.
+	runes := []rune{}
+	for cp := 0x4E00; cp <= 0x9FFF; cp += 7 {
+		runes = append(runes, rune(cp))
+	}
+	str := string(runes)
+	buf := Encode(str)
+	if ctrl := Decode(buf); ctrl != str {
+		t.Errorf("CJK ideographs decoded back as '%v'", ctrl)
+	}
+	if expected := 3 + 2*(len(runes)-1); len(buf) != expected {
+		t.Errorf("CJK ideographs encoded in %v bytes, expected %v", len(buf), expected)
+	}
+
+	// Chinese text with embedded digits and punctuation
+	str = testStrings[37]
+	if ratio := float64(EncodedLen(str)) / float64(len([]rune(str))); ratio > 2 {
+		t.Errorf("Chinese text encoded with %.2f bytes per character", ratio)
+	}
+}
+
+func BenchmarkChinese(b *testing.B) {
+	str := benchmarkScripts["Chinese"]
+	buf := Encode(str)
+	b.Run("Encode", func(b *testing.B) {
+		b.SetBytes(int64(len(str)))
+		for i := 0; i < b.N; i++ {
+			Encode(str)
+		}
+		b.ReportMetric(float64(len(buf))/float64(len(str)), "ratio")
+	})
+	b.Run("Decode", func(b *testing.B) {
+		b.SetBytes(int64(len(str)))
+		for i := 0; i < b.N; i++ {
+			Decode(buf)
+		}
+	})
+}
+
+func BenchmarkEncode21Bit(b *testing.B) {
+	// Characters of the current 21-bit alphabet take 2 bytes, and each switch between 21-bit alphabets takes 3.
+	// Storing them by index into a slice grown in advance isn't faster than appending them at once:
+	// append with several values checks the capacity only once as well.
+	inline := make([]rune, 0, 4096)
+	for cp := 0x4E00; len(inline) < cap(inline); cp++ {
+		inline = append(inline, rune(cp))
+	}
+	switches := []rune(strings.Repeat("中𝄞", 2048))
+	for _, test := range []struct {
+		name  string
+		runes []rune
+	}{{"Inline", inline}, {"Switch", switches}} {
+		str := string(test.runes)
+		b.Run(test.name, func(b *testing.B) {
+			b.SetBytes(int64(len(str)))
+			for i := 0; i < b.N; i++ {
+				Encode(str)
+			}
+		})
+	}
+}
+
+func TestEncodePrecedence(t *testing.T) {
+	for _, test := range []struct {
+		str string
+		buf []byte
+	}{
+		// Latin auxiliary alphabet is preferred over the current one: after switching from a 21-bit
+		// alphabet to Latin, both of them are Latin, but "a" is encoded as 0xDA instead of 0x61
+		{"日āa", []byte{0xA0, 0x3D, 0xE5, 0x81, 0x01, 0xDA}},
+		// Non-Latin auxiliary alphabet is preferred over extra ranges
+		{"ひらが", []byte{0xB9, 0x72, 0xB9, 0x89, 0xCC}},
+		// Current alphabet is preferred over extra ranges
+		{"かか", []byte{0xB9, 0x4B, 0x4B}},
+		// Auxiliary alphabet is preferred over switching (after a 21-bit switch it's not remapped)
+		{"Мир日М", []byte{0x84, 0x1C, 0x38, 0x40, 0xA0, 0x3D, 0xE5, 0xDC}},
+		// Latin characters outside of ASCII and auxiliary alphabet always require a switch
+		{"ÀàĀ¡à", []byte{0xC0, 0xE0, 0x81, 0x00, 0x80, 0xA1, 0x80, 0xE0}},
+	} {
+		if buf := Encode(test.str); !bytes.Equal(buf, test.buf) {
+			t.Errorf("String '%v' encoded as %v, expected %v", test.str, hexString(buf), hexString(test.buf))
+		}
+		if str := Decode(test.buf); str != test.str {
+			t.Errorf("Bytes %v decoded as '%v', expected '%v'", hexString(test.buf), str, test.str)
+		}
+	}
+}
+
+func TestStringEncoder(t *testing.T) {
+	var enc StringEncoder
+	for _, test := range testStrings {
+		if buf := enc.EncodeString(test); !bytes.Equal(buf, Encode(test)) {
+			t.Errorf("String '%v' encoded as %v, expected %v", test, hexString(buf), hexString(Encode(test)))
+		}
+		if buf := AppendEncode([]byte{1, 2}, test); !bytes.Equal(buf, append([]byte{1, 2}, Encode(test)...)) {
+			t.Errorf("String '%v' appended as %v", test, hexString(buf))
+		}
+	}
+
+	// The buffer is reused, so previous results are overwritten
+	first := enc.EncodeString("Привет")
+	kept := append([]byte{}, first...)
+	enc.EncodeString("Пока!!")
+	if bytes.Equal(first, kept) {
+		t.Errorf("Expected the buffer to be reused")
+	}
+
+	if allocs := testing.AllocsPerRun(100, func() { enc.EncodeString("Привет, мир") }); allocs != 0 {
+		t.Errorf("EncodeString allocated %v times per call", allocs)
+	}
+}
+
+// auxOffsetViolations checks the auxOffset table for entries that can't work as intended
+func auxOffsetViolations(table map[int]int) map[int]string {
+	violations := map[int]string{}
+	for offs, window := range table {
+		switch {
+		case offs == 0:
+			violations[offs] = "Latin is handled specially and must not be in the table"
+		case offs&^offsMask13Bit != 0:
+			violations[offs] = "key is not a multiple of 0x80, so it's never looked up"
+		case offs+0x80 > min21BitCp && offs != rangeHK[0] && offs != rangeHK[0]+0x80:
+			violations[offs] = "key is neither a 13-bit alphabet nor Hiragana/Katakana"
+		case window == 0:
+			violations[offs] = "window 0 would be treated as the Latin auxiliary alphabet"
+		case window < offs || window+0x3F >= offs+0x80:
+			violations[offs] = fmt.Sprintf("window U+%04X-U+%04X is outside of its block", window, window+0x3F)
+		}
+	}
+	return violations
+}
+
+func TestAuxOffsetTable(t *testing.T) {
+	// Armenian key is not aligned, so Armenian uses the default window (0x0500). The table is a part of the format,
+	// so this can't be fixed without breaking compatibility; use Options.AuxOffsets instead.
+	known := map[int]bool{0x0530: true}
+	for offs, msg := range auxOffsetViolations(auxOffset) {
+		if !known[offs] {
+			t.Errorf("auxOffset[0x%04X] = 0x%04X: %v", offs, auxOffset[offs], msg)
+		}
+	}
+	if _, ok := auxOffsetViolations(auxOffset)[0x0530]; !ok {
+		t.Errorf("Armenian entry is expected to be unreachable")
+	}
+
+	// Make sure the checks actually catch broken entries
+	for offs, window := range map[int]int{0x0000: 0x0041, 0x0400: 0x0000, 0x0480: 0x04C1, 0x0600: 0x0580, 0x0081: 0x00C0, 0x2800: 0x2800} {
+		if len(auxOffsetViolations(map[int]int{offs: window})) != 1 {
+			t.Errorf("Entry 0x%04X: 0x%04X is not reported as broken", offs, window)
+		}
+	}
+}
+
+func TestArmenian(t *testing.T) {
+	// Uppercase letters are U+0531-U+0556, lowercase ones are U+0561-U+0587. Since the Armenian entry of auxOffset
+	// is unreachable, leaving Armenian text (block 0x0500) sets the aux window to U+0500-U+053F, so only 15 uppercase
+	// letters (U+0531-U+053F) get 1-byte encoding after a switch (here, to Latin via a comma, which is not in the Latin
+	// auxiliary alphabet). Leaving block 0x0580 sets it to Hebrew.
+	cost := func(prefix string, cp int, opts Options) int {
+		st := initState()
+		for _, ch := range prefix {
+			st.encodeRune(nil, int(ch), &opts)
+		}
+		return len(st.encodeRune(nil, cp, &opts))
+	}
+	for cp := 0x0531; cp <= 0x0587; cp++ {
+		if cp > 0x0556 && cp < 0x0561 {
+			continue
+		}
+		// Inside Armenian text all letters of the block 0x0500 are 1 byte, the last 7 lowercase ones need a switch
+		inside := 1
+		if cp >= 0x0580 {
+			inside = 2
+		}
+		if n := cost("Բեկ", cp, Options{}); n != inside {
+			t.Errorf("U+%04X after Armenian takes %d bytes, expected %d", cp, n, inside)
+		}
+		afterAux := 2
+		if cp <= 0x053F {
+			afterAux = 1
+		}
+		if n := cost("Բեկ,", cp, Options{}); n != afterAux {
+			t.Errorf("U+%04X after Armenian and a comma takes %d bytes, expected %d", cp, n, afterAux)
+		}
+		if n := cost("ր,", cp, Options{}); n != 2 {
+			t.Errorf("U+%04X after U+0580 and a comma takes %d bytes, expected 2", cp, n)
+		}
+		// The default window can't be changed without breaking compatibility, but it can be overridden
+		// to cover the lowercase letters of the block 0x0500 instead
+		custom := 2
+		if cp >= 0x0540 && cp <= 0x057F {
+			custom = 1
+		}
+		if n := cost("Բեկ,", cp, Options{AuxOffsets: map[int]int{0x0500: 0x0540}}); n != custom {
+			t.Errorf("U+%04X with a custom aux offset takes %d bytes, expected %d", cp, n, custom)
+		}
+	}
+}
+
+func TestLatin1Supplement(t *testing.T) {
+	// Initially the auxiliary alphabet is U+00C0-U+00FF (accented letters), so they take 1 byte in Latin text,
+	// while symbols of U+0080-U+00BF (including "¡" and "¿") switch to Latin and take 2 bytes
+	for cp := 0x80; cp <= 0xFF; cp++ {
+		expected := 2
+		if cp >= offsInitAux {
+			expected = 1
+		}
+		str := "a" + string(rune(cp)) + "b"
+		if n := EncodedLen(str); n != expected+2 {
+			t.Errorf("U+%04X in Latin text takes %d bytes, expected %d", cp, n-2, expected)
+		}
+		if ctrl := Decode(Encode(str)); ctrl != str {
+			t.Errorf("String %+q decoded back as %+q", str, ctrl)
+		}
+	}
+	// Such a switch replaces the auxiliary alphabet with rearranged ASCII (as for any switch from Latin),
+	// so accented letters after "¿" or "«" take 2 bytes as well. This is a part of the format. For Western European
+	// text it can be avoided with custom AuxOffsets, at the cost of Latin auxiliary alphabet in non-Latin text.
+	opts := Options{AuxOffsets: map[int]int{0x0000: offsInitAux}}
+	for _, test := range []struct {
+		str           string
+		size, optSize int
+	}{
+		{"¿Qué pasó? ¡Olé!", 21, 18},
+		{"¿Dónde está el niño?", 24, 21},
+		{"Voilà, c'est l'été à Noël «déjà» vu.", 40, 38},
+		{"Straße über Größe", 17, 17},
+	} {
+		buf, err := EncodeWith(test.str, opts)
+		if n := EncodedLen(test.str); n != test.size || len(buf) != test.optSize || err != nil {
+			t.Errorf("String '%v' encoded in %v bytes (%v with options, %v), expected %v and %v", test.str, n, len(buf), err, test.size, test.optSize)
+		}
+		if ctrl, err := DecodeWith(buf, opts); err != nil || ctrl != test.str {
+			t.Errorf("String '%v' decoded back as '%v' (%v)", test.str, ctrl, err)
+		}
+	}
+}
+
+func TestAuxBoundaries(t *testing.T) {
+	// The auxiliary alphabet covers 64 codepoints from auxOffs inclusive: U+00C0-U+00FF initially,
+	// U+0410-U+044F after leaving Cyrillic
+	tests := []struct {
+		str      string
+		expected []byte
+	}{
+		{"\u00BF", []byte{0x80, 0xBF}},
+		{"\u00C0", []byte{0xC0}},
+		{"\u00FF", []byte{0xFF}},
+		{"\u0100", []byte{0x81, 0x00}},
+		{"Ж!\u040F", []byte{0x84, 0x16, 0x80, 0x21, 0x84, 0x0F}},
+		{"Ж!\u0410", []byte{0x84, 0x16, 0x80, 0x21, 0xC0}},
+		{"Ж!\u044F", []byte{0x84, 0x16, 0x80, 0x21, 0xFF}},
+		{"Ж!\u0450", []byte{0x84, 0x16, 0x80, 0x21, 0x84, 0x50}},
+	}
+	for _, test := range tests {
+		buf := Encode(test.str)
+		if !bytes.Equal(buf, test.expected) {
+			t.Errorf("String %+q is encoded as % x instead of % x", test.str, buf, test.expected)
+		}
+		if ctrl := Decode(buf); ctrl != test.str {
+			t.Errorf("String %+q decoded back as %+q", test.str, ctrl)
+		}
+	}
+}
+
+func TestBidiMarks(t *testing.T) {
+	// Directional marks are in the first extra range: they take 2 bytes each, but don't change the state,
+	// so the surrounding RTL text is encoded exactly as it would be without them
+	marks := []string{"\u200E", "\u200F", "\u202A", "\u202B", "\u202C", "\u202D", "\u202E"}
+	for _, test := range []string{"שלום עולם, \u200FHello\u200E עולם", "مرحبا بالعالم 123 مرحبا"} {
+		words := strings.Split(test, " ")
+		for i, mark := range marks {
+			str := strings.Join(words, mark+" ")
+			buf := Encode(str)
+			if ctrl := Decode(buf); ctrl != str {
+				t.Errorf("String '%v' decoded back as '%v', bytes: %v", str, ctrl, hexString(buf))
+			}
+			plain := strings.Replace(str, mark, "", -1)
+			if expected := EncodedLen(plain) + 2*strings.Count(str, mark); len(buf) != expected {
+				t.Errorf("Mark %v: string '%v' encoded in %v bytes, expected %v", i, str, len(buf), expected)
+			}
+		}
+	}
+}
+
+func TestNeeds3Byte(t *testing.T) {
+	for _, test := range []struct {
+		str   string
+		runes string
+	}{
+		{"", ""},
+		{"Привет, мир", ""},
+		{"🔥かな₠", ""},
+		{"中文", "中"},
+		{"中𝄞中", "中𝄞中"},
+		{"中文 and 中文", "中"},
+		{"中文 and Русский and 中文", "中中"},
+	} {
+		if runes := Needs3Byte(test.str); string(runes) != test.runes {
+			t.Errorf("String '%v' requires 3 bytes for '%v', expected '%v'", test.str, string(runes), test.runes)
+		}
+	}
+	// Cross-check with the decoder
+	opts := Options{}
+	for _, test := range testStrings {
+		buf, st, n := Encode(test), initState(), 0
+		for i := 0; i < len(buf); {
+			_, size, _ := st.decodeRune(buf, i, &opts)
+			if size == 3 {
+				n++
+			}
+			i += size
+		}
+		if len(Needs3Byte(test)) != n {
+			t.Errorf("String '%v' requires 3 bytes for '%v', but has %v 3-byte sequences", test, string(Needs3Byte(test)), n)
+		}
+	}
+}
+
+func TestAlternating21Bit(t *testing.T) {
+	// Astral (non-extra) characters switch to 21-bit mode, BMP characters below min21BitCp switch back.
+	// The 21-bit switch stores offs in auxOffs without remapping it (unlike the 13-bit one), but the decoder
+	// does the same, so this doesn't break round-trips.
+	astral := []rune("𝄞𠀀中한ꙮ")
+	bmp := []rune("aЖéשか₠")
+	rnd := rand.New(rand.NewSource(134))
+	for i := 0; i < 2000; i++ {
+		runes := make([]rune, 1+rnd.Intn(30))
+		for j := range runes {
+			if j%2 == 0 {
+				runes[j] = astral[rnd.Intn(len(astral))]
+			} else {
+				runes[j] = bmp[rnd.Intn(len(bmp))]
+			}
+		}
+		str := string(runes)
+		buf := Encode(str)
+		if ctrl, err := DecodeSafe(buf); err != nil || ctrl != str {
+			t.Fatalf("String '%v' decoded back as '%v' (%v), bytes: %v", str, ctrl, err, hexString(buf))
+		}
+		// No character takes more than 3 bytes, no matter how often the mode changes
+		if len(buf) > 3*len(runes) {
+			t.Errorf("String '%v' encoded in %v bytes", str, len(buf))
+		}
+	}
+
+	// The 21-bit alphabet is kept while BMP characters are encoded via the auxiliary alphabet,
+	// so after the first few switches each pair takes 3 bytes instead of 5
+	for _, test := range []struct {
+		str string
+		buf []byte
+	}{
+		{"𝄞Ж𝄞Ж𝄞Ж", []byte{0xA1, 0xA9, 0x1E, 0x84, 0x16, 0xA1, 0xA9, 0x1E, 0xD6, 0x29, 0x1E, 0xD6}},
+		{"中a中a", []byte{0xA0, 0x26, 0x2D, 0xDA, 0x26, 0x2D, 0xDA}},
+		{"𝄞é𝄞é", []byte{0xA1, 0xA9, 0x1E, 0x80, 0xE9, 0xA1, 0xA9, 0x1E, 0x80, 0xE9}},
+	} {
+		if buf := Encode(test.str); !bytes.Equal(buf, test.buf) {
+			t.Errorf("String '%v' encoded as %v, expected %v", test.str, hexString(buf), hexString(test.buf))
+		}
+	}
+}
+
+func TestWithin21BitAlphabet(t *testing.T) {
+	// Every character of a 21-bit alphabet after the switch takes 2 bytes: the high one is below 0x80 and
+	// holds bits 8-14 of the offset from min21BitCp, which the decoder combines with the alphabet offset.
+	// Extra ranges inside the alphabet keep their own 2-byte encoding and don't change the state.
+	for _, offs := range []int{0x8000, 0x10000, 0x18000, 0xE8000, 0x100000, 0x108000} {
+		for _, descending := range []bool{false, true} {
+			runes := []rune{}
+			for cp := min21BitCp + offs; cp < min21BitCp+offs+0x8000 && cp <= utf8.MaxRune; cp++ {
+				if utf8.ValidRune(rune(cp)) {
+					runes = append(runes, rune(cp))
+				}
+			}
+			if descending {
+				for i, j := 0, len(runes)-1; i < j; i, j = i+1, j-1 {
+					runes[i], runes[j] = runes[j], runes[i]
+				}
+			}
+			str := string(runes)
+			buf := Encode(str)
+			if len(buf) != 3+2*(len(runes)-1) {
+				t.Errorf("Alphabet 0x%X (descending: %v) encoded with %d bytes for %d characters", offs, descending, len(buf), len(runes))
+			}
+			for k, ch := range runes[1:] {
+				cp := int(ch)
+				pair := buf[3+2*k : 5+2*k]
+				if inRanges(cp, rangesExtra) {
+					continue
+				}
+				if expected := []byte{byte((cp - min21BitCp) >> 8 & 0x7F), byte(cp)}; !bytes.Equal(pair, expected) {
+					t.Errorf("U+%04X encoded as %v, expected %v", cp, hexString(pair), hexString(expected))
+				}
+			}
+			if ctrl, err := DecodeSafe(buf); err != nil || ctrl != str {
+				t.Errorf("Alphabet 0x%X (descending: %v) was not decoded back (%v)", offs, descending, err)
+			}
+		}
+	}
+}
+
+func TestAuxAfter21Bit(t *testing.T) {
+	// After 21-bit switches auxOffs is not remapped, which is frozen in the format.
+	// These vectors pin down both the round-trip and the resulting sizes.
+	for _, test := range []struct {
+		str string
+		buf []byte
+	}{
+		// Cyrillic: the auxiliary alphabet becomes U+0400-U+043F instead of U+0410-U+044F
+		{"Ж𝄞Ѐ", []byte{0x84, 0x16, 0xA1, 0xA9, 0x1E, 0xC0}},
+		{"Ж𝄞Я", []byte{0x84, 0x16, 0xA1, 0xA9, 0x1E, 0xEF}},
+		{"Ж𝄞ш", []byte{0x84, 0x16, 0xA1, 0xA9, 0x1E, 0x84, 0x48}},
+		{"Жш", []byte{0x84, 0x16, 0x48}},
+		// Greek: U+0380-U+03BF instead of U+0391-U+03D0, so ω (U+03C9) is no longer in the auxiliary alphabet
+		{"α𝄞ω", []byte{0x83, 0xB1, 0xA1, 0xA9, 0x1E, 0x83, 0xC9}},
+		// Two different 21-bit alphabets: the offs of 中 (0) becomes auxOffs, which means Latin
+		{"Ж中𝄞a", []byte{0x84, 0x16, 0xA0, 0x26, 0x2D, 0xA1, 0xA9, 0x1E, 0xDA}},
+		// Leaving a 21-bit alphabet via a 13-bit switch remaps its offs as well
+		{"中Жa", []byte{0xA0, 0x26, 0x2D, 0x84, 0x16, 0xDA}},
+	} {
+		buf := Encode(test.str)
+		if !bytes.Equal(buf, test.buf) {
+			t.Errorf("String '%v' encoded as %v, expected %v", test.str, hexString(buf), hexString(test.buf))
+		}
+		if ctrl, err := DecodeSafe(buf); err != nil || ctrl != test.str {
+			t.Errorf("String '%v' decoded back as '%v' (%v)", test.str, ctrl, err)
+		}
+	}
+}
+
+func TestEncodeBatch(t *testing.T) {
+	strs := []string{"Привет", "", "Привет", "mode", "日本語", "mode", "Привет"}
+	out, err := EncodeBatch(strs)
+	if err != nil || len(out) != len(strs) {
+		t.Fatalf("EncodeBatch returned %v results (%v)", len(out), err)
+	}
+	for i, str := range strs {
+		if !bytes.Equal(out[i], Encode(str)) {
+			t.Errorf("String '%v' encoded as %v, expected %v", str, hexString(out[i]), hexString(Encode(str)))
+		}
+	}
+	// Appending to one result must not affect the others
+	_ = append(out[0], 0xFF)
+	if !bytes.Equal(out[3], Encode("mode")) {
+		t.Errorf("Appending to a result overwrote another one: %v", hexString(out[3]))
+	}
+}
+
+func TestSpacesInNonLatinText(t *testing.T) {
+	// After the first switch from Latin it becomes the auxiliary alphabet, so spaces (and digits, "-")
+	// take 1 byte without any switches: only the first letter costs an extra byte
+	for _, str := range []string{"Привет мир как дела", "Γειά σου κόσμε", "שלום עולם מה נשמע", "مرحبا بالعالم", "สวัสดี ชาวโลก", "Мир 2020-2021"} {
+		if n, runes := EncodedLen(str), utf8.RuneCountInString(str); n != runes+1 {
+			t.Errorf("String '%v' encoded in %v bytes, expected %v", str, n, runes+1)
+		}
+	}
+	// Other punctuation requires a switch to Latin, but then Cyrillic becomes auxiliary (U+0410-U+044F),
+	// so the rest of the text still takes 1 byte per character
+	if n := EncodedLen("Привет, мир! Как дела?"); n != 24 {
+		t.Errorf("Punctuated string encoded in %v bytes, expected 24", n)
+	}
+}
+
+func BenchmarkSpacedCyrillic(b *testing.B) {
+	str := strings.Repeat("Съешь же ещё этих мягких французских булок, да выпей чаю. ", 20)
+	b.SetBytes(int64(len(str)))
+	var n int
+	for i := 0; i < b.N; i++ {
+		n = len(Encode(str))
+	}
+	b.ReportMetric(float64(n)/float64(utf8.RuneCountInString(str)), "bytes/rune")
+}
+
+func TestDigitsInNonLatinText(t *testing.T) {
+	digitCost := func(str string) (digits, n int) {
+		opts := Options{}
+		st := initState()
+		for _, ch := range str {
+			size := len(st.encodeRune(nil, int(ch), &opts))
+			if ch >= '0' && ch <= '9' {
+				digits, n = digits+1, n+size
+			}
+		}
+		return
+	}
+	// Digits are a part of the Latin auxiliary alphabet, and after punctuation Latin is the current one,
+	// so in text mixing a single script with Latin every digit takes 1 byte
+	for _, str := range []string{
+		"رقم الهاتف 0123456789 والتاريخ 2024/10/14، الساعة 15:30",
+		"Телефон: 8 (495) 123-45-67, дата 14.10.2024",
+		"2024年10月14日に会議があります。電話は03-1234-5678です。",
+		"שלום 123 עולם 456",
+	} {
+		if digits, n := digitCost(str); n != digits {
+			t.Errorf("Digits of '%v' take %v bytes, expected %v", str, n, digits)
+		}
+	}
+	// When two non-Latin alphabets are mixed, Latin is no longer auxiliary, so the first ASCII character after them
+	// switches to it. A dedicated path for digits would not help: there are no spare 1-byte codes, and the switch
+	// is paid once per run (here, by the space), whatever character it starts with
+	if digits, n := digitCost("Ελλάδα Россия 2024 Ελλάδα"); n != digits {
+		t.Errorf("Digits take %v bytes, expected %v", n, digits)
+	}
+	if n := EncodedLen(" 2024"); EncodedLen("Ελλάδα Россия 2024")-EncodedLen("Ελλάδα Россия") != n+1 {
+		t.Errorf("Expected a single switch before the digits")
+	}
+}
+
+func BenchmarkArabicWithNumbers(b *testing.B) {
+	str := strings.Repeat("رقم الهاتف 0123456789 والتاريخ 2024/10/14، الساعة 15:30. ", 20)
+	b.SetBytes(int64(len(str)))
+	var n int
+	for i := 0; i < b.N; i++ {
+		n = len(Encode(str))
+	}
+	b.ReportMetric(float64(n)/float64(utf8.RuneCountInString(str)), "bytes/rune")
+}
+
+func TestPunctuationPenalty(t *testing.T) {
+	for _, test := range []struct {
+		str     string
+		penalty int
+	}{
+		{"", 0},
+		{"Hello, World!", 0},
+		{"Привет мир", 0},
+		{"Привет, мир", 1},
+		// After the comma Cyrillic is auxiliary, and "!" is in the current alphabet
+		{"Привет, мир!", 1},
+		// Leaving a 21-bit alphabet is more expensive
+		{"中文, 中文", 2},
+		{"Привет...", 1},
+	} {
+		if penalty := PunctuationPenalty(test.str); penalty != test.penalty {
+			t.Errorf("String '%v' has penalty %v, expected %v", test.str, penalty, test.penalty)
+		}
+	}
+}
+
+func TestAstralPlanes(t *testing.T) {
+	roundTrip := func(str string) {
+		if ctrl, err := DecodeSafe(Encode(str)); err != nil || ctrl != str {
+			t.Errorf("String %+q decoded back as %+q (%v), bytes: %v", str, ctrl, err, hexString(Encode(str)))
+		}
+	}
+	// Every codepoint of planes 1 (SMP), 2 (CJK Extension B) and 14 (tags and variation selectors),
+	// both as a switch and as a character in the current 21-bit alphabet
+	for _, plane := range []rune{1, 2, 14} {
+		for ch := plane << 16; ch < (plane+1)<<16; ch++ {
+			roundTrip(string([]rune{ch, ch ^ 1, 'a'}))
+		}
+	}
+	// Start and end of every plane, with the neighboring 21-bit alphabets
+	for plane := rune(1); plane <= 16; plane++ {
+		first, last := plane<<16, plane<<16|0xFFFF
+		roundTrip(string([]rune{first, last, first - 1, last - 0x8000, 'Ж', first}))
+	}
+	// Marker arithmetic at the boundaries. Only codepoints from U+102800 produce the 0xB0 marker,
+	// which is why extra ranges can use 0xB1-0xBF.
+	for _, test := range []struct {
+		str string
+		buf []byte
+	}{
+		{"\U0000FFFF", []byte{0xA0, 0xD7, 0xFF}},
+		{"\U00010000", []byte{0xA0, 0xD8, 0x00}},
+		{"\U00012800", []byte{0xA1, 0x00, 0x00}},
+		{"\U000E0001", []byte{0xAD, 0xD8, 0x01}},
+		{"\U00102800", []byte{0xB0, 0x00, 0x00}},
+		{"\U0010FFFF", []byte{0xB0, 0xD7, 0xFF}},
+	} {
+		if buf := Encode(test.str); !bytes.Equal(buf, test.buf) {
+			t.Errorf("String %+q encoded as %v, expected %v", test.str, hexString(buf), hexString(test.buf))
+		}
+	}
+}
+
+func TestSupplementaryPrivateUse(t *testing.T) {
+	// Planes 15 (SPUA-A) and 16 (SPUA-B) are the top of the codepoint space, where the high byte of the 21-bit marker
+	// reaches 0x10 (U+102800 and above use 0xB0, just below the markers of extra ranges)
+	for ch := rune(0xF0000); ch <= utf8.MaxRune; ch++ {
+		buf := Encode(string([]rune{ch, ch ^ 1, ch}))
+		if len(buf) != 7 {
+			t.Errorf("U+%04X encoded with %d bytes: %v", ch, len(buf), hexString(buf))
+		}
+		if ctrl, err := DecodeSafe(buf); err != nil || ctrl != string([]rune{ch, ch ^ 1, ch}) {
+			t.Errorf("U+%04X decoded back as %+q (%v), bytes: %v", ch, ctrl, err, hexString(buf))
+		}
+	}
+	// Switching between the alphabets around the plane boundaries
+	str := "\U000EFFFF\U000F0000\U000FFFFD\U000FFFFF\U00100000\U001027FF\U00102800\U0010FFFD\U0010FFFF\U000F0000"
+	if ctrl, err := DecodeSafe(Encode(str)); err != nil || ctrl != str {
+		t.Errorf("String %+q decoded back as %+q (%v)", str, ctrl, err)
+	}
+	// Anything above U+10FFFF is rejected, both as a switch and within the current alphabet
+	for _, buf := range [][]byte{{0xB0, 0xD8, 0x00}, {0xB0, 0xFF, 0xFF}, {0xB0, 0xD7, 0xFF, 0x58, 0x00}} {
+		if _, err := DecodeSafe(buf); !errors.Is(err, ErrInvalid) {
+			t.Errorf("Bytes %v: expected ErrInvalid, got %v", hexString(buf), err)
+		}
+	}
+}
+
+func TestValid(t *testing.T) {
+	for _, test := range testStrings {
+		if buf := Encode(test); !Valid(buf) {
+			t.Errorf("Encoding of '%v' is not valid: %v", test, hexString(buf))
+		}
+	}
+	for _, test := range []struct {
+		buf   []byte
+		valid bool
+	}{
+		{[]byte{}, true},
+		{[]byte("plain English text"), true},
+		// ASCII prefix followed by markers
+		{[]byte{'a', 'b', 0x84, 0x1C, 0x38}, true},
+		{[]byte{'a', 'b', 0x84}, false},
+		{[]byte{'a', 'b', 0xBF, 0xFF}, false},
+		{[]byte{'a', 'b', marker21Bit, 0x01}, false},
+	} {
+		if valid := Valid(test.buf); valid != test.valid {
+			t.Errorf("Bytes %v are reported as valid: %v, expected %v", hexString(test.buf), valid, test.valid)
+		}
+	}
+	// Must agree with DecodeSafe
+	rnd := rand.New(rand.NewSource(141))
+	for i := 0; i < 10000; i++ {
+		buf := make([]byte, rnd.Intn(8))
+		rnd.Read(buf)
+		if _, err := DecodeSafe(buf); Valid(buf) != (err == nil) {
+			t.Errorf("Bytes %v: Valid returned %v, but DecodeSafe returned %v", hexString(buf), Valid(buf), err)
+		}
+	}
+}
+
+func TestLooksLikeUTFC(t *testing.T) {
+	// UTF-C of non-ASCII text is practically never valid UTF-8, and vice versa
+	for _, test := range testStrings {
+		if isASCII(test) {
+			continue
+		}
+		if !LooksLikeUTFC(Encode(test)) {
+			t.Errorf("UTF-C of '%v' is not detected, bytes: %v", test, hexString(Encode(test)))
+		}
+		if LooksLikeUTFC([]byte(test)) {
+			t.Errorf("UTF-8 of '%v' is detected as UTF-C", test)
+		}
+	}
+	for _, test := range []struct {
+		buf    []byte
+		result bool
+	}{
+		{nil, false},
+		{[]byte("plain ASCII"), false},    // The same in both encodings
+		{[]byte{0xC3, 0xA9}, false},       // "é" in UTF-8 (in UTF-C it's "Ã" and a truncated sequence)
+		{[]byte{0xE9}, true},              // "é" in UTF-C
+		{[]byte{0xC3, 0xA9, 0, 0}, false}, // Both "Ã\U00092800" in UTF-C and "é\x00\x00" in UTF-8
+		{[]byte{0xBF, 0xFF}, false},       // Neither
+	} {
+		if result := LooksLikeUTFC(test.buf); result != test.result {
+			t.Errorf("LooksLikeUTFC(%v) = %v, expected %v", hexString(test.buf), result, test.result)
+		}
+	}
+	if Decode([]byte{0xC3, 0xA9, 0, 0}) != "Ã\U00092800" {
+		t.Errorf("Unexpected ambiguous example")
+	}
+}
+
+func BenchmarkValidASCII(b *testing.B) {
+	buf := Encode(benchmarkScripts["ASCII"])
+	b.SetBytes(int64(len(buf)))
+	for i := 0; i < b.N; i++ {
+		Valid(buf)
+	}
+}
+
+func TestJoiners(t *testing.T) {
+	// ZWJ and ZWNJ are in the first extra range, so just like directional marks they take 2 bytes
+	// without changing the state. There are no free 1-byte codes in any state, so a cheaper encoding would have to
+	// take a byte value from some other character, making the output incompatible with other decoders.
+	for _, test := range []string{
+		"क्\u200Dष र्\u200Dय क्\u200Cष", // Devanagari conjuncts with ZWJ and ZWNJ
+		"हिन्दी भाषा में स्\u200Dवागत",
+		"ന്\u200D ണ്\u200D ല്\u200D",            // Malayalam chillu forms written with ZWJ
+		"👨\u200D👩\u200D👧\u200D👦 🏳\uFE0F\u200D🌈", // Emoji ZWJ sequences
+	} {
+		buf := Encode(test)
+		if ctrl, err := DecodeSafe(buf); err != nil || ctrl != test {
+			t.Errorf("String %+q decoded back as %+q (%v), bytes: %v", test, ctrl, err, hexString(buf))
+		}
+		n := strings.Count(test, "\u200D") + strings.Count(test, "\u200C")
+		plain := strings.NewReplacer("\u200D", "", "\u200C", "").Replace(test)
+		if expected := EncodedLen(plain) + 2*n; len(buf) != expected {
+			t.Errorf("String %+q encoded in %v bytes, expected %v", test, len(buf), expected)
+		}
+	}
+}
+
+func BenchmarkHindi(b *testing.B) {
+	str := strings.Repeat("भारत एक विशाल देश है। क्\u200Dया आप हिन्दी बोलते हैं? ", 20)
+	b.SetBytes(int64(len(str)))
+	var n int
+	for i := 0; i < b.N; i++ {
+		n = len(Encode(str))
+	}
+	b.ReportMetric(float64(n)/float64(utf8.RuneCountInString(str)), "bytes/rune")
+}
+
+func TestMarkerPrefixes(t *testing.T) {
+	// Classify the first byte by the marker bit patterns, independently from the order of checks in decodeRune
+	const (
+		inline = iota
+		aux
+		extra
+		long
+		short
+	)
+	classify := func(b byte) (int, int) {
+		class, matches := -1, 0
+		for c, match := range []bool{
+			inline: b&0x80 == 0,
+			aux:    b&markerAux == markerAux,
+			extra:  b&0xF0 == markerExtra && b != markerExtra,
+			long:   b&0xE0 == marker21Bit && !(b&0xF0 == markerExtra && b != markerExtra),
+			short:  b&0xE0 == marker13Bit,
+		} {
+			if match {
+				class, matches = c, matches+1
+			}
+		}
+		return class, matches
+	}
+	lengths := map[int][2]int{ // Sequence length in 13-bit and 21-bit modes
+		inline: {1, 2},
+		aux:    {1, 1},
+		extra:  {2, 2},
+		long:   {3, 3},
+		short:  {2, 2},
+	}
+
+	opts := Options{}
+	for b := 0; b < 0x100; b++ {
+		class, matches := classify(byte(b))
+		if matches != 1 {
+			t.Errorf("Byte 0x%02X matches %v markers", b, matches)
+			continue
+		}
+		for mode, st := range []state{initState(), {offs: 0, auxOffs: 0, is21Bit: true}} {
+			if _, n, err := st.decodeRune([]byte{byte(b), 0, 0}, 0, &opts); err != nil || n != lengths[class][mode] {
+				t.Errorf("Byte 0x%02X (class %v) is decoded as a %v-byte sequence (%v)", b, class, n, err)
+			}
+		}
+	}
+
+	// Every sequence produced by the encoder must start with a byte of the class matching its length
+	seen := map[int]bool{}
+	for _, st := range []state{initState(), {offs: 0x0400, auxOffs: 0x0410}, {offs: 0, auxOffs: 0, is21Bit: true}} {
+		for cp := 0; cp <= utf8.MaxRune; cp++ {
+			if !utf8.ValidRune(rune(cp)) {
+				continue
+			}
+			next := st
+			mode := 0
+			if next.is21Bit {
+				mode = 1
+			}
+			seq := next.encodeRune(nil, cp, &opts)
+			class, _ := classify(seq[0])
+			if len(seq) != lengths[class][mode] {
+				t.Fatalf("U+%04X is encoded as %v, but its first byte denotes a %v-byte sequence", cp, hexString(seq), lengths[class][mode])
+			}
+			seen[class] = true
+		}
+	}
+	if len(seen) != len(lengths) {
+		t.Errorf("Encoder produced only %v classes of first bytes", len(seen))
+	}
+}
+
+func TestMarkerKind(t *testing.T) {
+	for _, test := range []struct {
+		from, to int
+		kind     Kind
+	}{
+		{0x00, 0x7F, Inline},
+		{0x80, 0x9F, Bits13},
+		{0xA0, 0xB0, Bits21},
+		{0xB1, 0xBF, Extra},
+		{0xC0, 0xFF, Aux},
+	} {
+		for b := test.from; b <= test.to; b++ {
+			if kind := MarkerKind(byte(b)); kind != test.kind {
+				t.Errorf("Byte 0x%02X has kind %v, expected %v", b, kind, test.kind)
+			}
+		}
+	}
+}
+
+func TestSwitchesAreForced(t *testing.T) {
+	// With MinimizeSwitches the encoder changes the state only when the character has no encoding in the current state
+	// (via current or auxiliary alphabets, or extra ranges). Check it by enumerating all sequences that keep the state unchanged.
+	opts := Options{MinimizeSwitches: true}
+	reachable := func(st state) map[int]bool {
+		cps := map[int]bool{}
+		var seqs [][]byte
+		for b := 0; b < 0x80; b++ {
+			if st.is21Bit {
+				for b2 := 0; b2 < 0x100; b2++ {
+					seqs = append(seqs, []byte{byte(b), byte(b2)})
+				}
+			} else {
+				seqs = append(seqs, []byte{byte(b)})
+			}
+		}
+		for b := markerAux; b < 0x100; b++ {
+			seqs = append(seqs, []byte{byte(b)})
+		}
+		for v := 0; v < 0xF00; v++ {
+			seqs = append(seqs, []byte{byte(markerExtra | (1 + v>>8)), byte(v)})
+		}
+		for _, seq := range seqs {
+			next := st
+			if cp, _, err := next.decodeRune(seq, 0, &opts); err == nil && next == st {
+				cps[cp] = true
+			}
+		}
+		return cps
+	}
+	cache := map[state]map[int]bool{}
+	avoidable := func(str string, opts *Options) int {
+		n := 0
+		st := initState()
+		for _, ch := range str {
+			prev := st
+			st.encodeRune(nil, int(ch), opts)
+			if st == prev {
+				continue
+			}
+			if cache[prev] == nil {
+				cache[prev] = reachable(prev)
+			}
+			if cache[prev][int(ch)] {
+				n++
+			}
+		}
+		return n
+	}
+	for _, test := range append(testStrings, "Ж𝄞Ѐ", "中Жa", "ひらがなカタカナ", "a¡b", "漢字かな") {
+		if n := avoidable(test, &opts); n != 0 {
+			t.Errorf("String '%v' has %v avoidable switches", test, n)
+		}
+	}
+	// By default kana after ideographs switch to their own alphabet
+	if n := avoidable("漢字かな", &Options{}); n != 1 {
+		t.Errorf("Expected 1 avoidable switch, got %v", n)
+	}
+}
+
+func TestMinimizeSwitches(t *testing.T) {
+	opts := Options{MinimizeSwitches: true}
+	for _, test := range testStrings {
+		buf, _ := EncodeWith(test, opts)
+		if ctrl, err := DecodeSafe(buf); err != nil || ctrl != test {
+			t.Errorf("String '%v' decoded back as '%v' (%v)", test, ctrl, err)
+		}
+	}
+	for _, test := range []struct {
+		str          string
+		def, minimal int
+	}{
+		// Single kana between ideographs: no 3-byte switches back to the 21-bit alphabet
+		{"漢か漢か漢か", 15, 13},
+		{"私は日本語を話します", 21, 21},
+		// Long run of kana after an ideograph: each kana takes 2 bytes instead of 1
+		{"字ひらがなひらがな", 13, 19},
+		// Typical Japanese text has enough kana runs to make the output longer
+		{testStrings[33], 654, 672},
+	} {
+		buf, _ := EncodeWith(test.str, opts)
+		if len(Encode(test.str)) != test.def || len(buf) != test.minimal {
+			t.Errorf("String '%v' encoded in %v bytes by default and %v with MinimizeSwitches, expected %v and %v",
+				test.str, len(Encode(test.str)), len(buf), test.def, test.minimal)
+		}
+	}
+}
+
+func TestEncodeBounded(t *testing.T) {
+	for _, test := range testStrings {
+		full := Encode(test)
+		for _, max := range []int{0, 1, 2, 3, 5, len(full) / 2, len(full) - 1, len(full), len(full) + 10} {
+			buf, runes, fits := EncodeBounded(test, max)
+			if fits != (len(full) <= max) {
+				t.Errorf("String '%v' with limit %v: fits is %v for %v bytes", test, max, fits, len(full))
+			}
+			if len(buf) > max || !bytes.HasPrefix(full, buf) {
+				t.Errorf("String '%v' with limit %v: encoded as %v", test, max, hexString(buf))
+			}
+			// The prefix must be maximal: the next character doesn't fit
+			prefix := string([]rune(test)[:runes])
+			if Decode(buf) != prefix || (!fits && EncodedLen(string([]rune(test)[:runes+1])) <= max) {
+				t.Errorf("String '%v' with limit %v: got %v characters '%v'", test, max, runes, Decode(buf))
+			}
+		}
+	}
+	if buf, runes, fits := EncodeBounded("abc", -1); len(buf) != 0 || runes != 0 || fits {
+		t.Errorf("Negative limit gave %v, %v, %v", hexString(buf), runes, fits)
+	}
+}
+
+func TestExtraRangeState(t *testing.T) {
+	opts := Options{}
+	// Hiragana and Katakana switch to their 13-bit alphabet, so the following characters of the same window take 1 byte
+	for _, test := range []struct {
+		str  string
+		offs int
+		buf  []byte
+	}{
+		{"ひらがな", 0x3080, []byte{0xB9, 0x72, 0xB9, 0x89, 0xCC, 0xEA}},
+		{"あいう", 0x3000, []byte{0xB9, 0x42, 0x44, 0x46}},
+		{"カタカナ", 0x3080, []byte{0xB9, 0xAB, 0x3F, 0x2B, 0x4A}},
+		// Hiragana after a 21-bit character leaves 21-bit mode
+		{"中あい", 0x3000, []byte{0xA0, 0x26, 0x2D, 0xB9, 0x42, 0x44}},
+	} {
+		st := initState()
+		buf := []byte{}
+		for _, ch := range test.str {
+			buf = st.encodeRune(buf, int(ch), &opts)
+		}
+		if st.offs != test.offs || st.is21Bit || !bytes.Equal(buf, test.buf) {
+			t.Errorf("String '%v' encoded as %v, state %+v, expected %v with offs 0x%04X", test.str, hexString(buf), st, hexString(test.buf), test.offs)
+		}
+	}
+
+	// Other extra ranges (general punctuation, variation selectors and emojis) don't change the state at all
+	for _, prefix := range []string{"", "Мир", "中文", "ひら", "𝄞"} {
+		for _, ch := range []rune{'‐', '€', '\uFE0F', '🅰', '🔥', '😀', '🤔'} {
+			st := initState()
+			for _, c := range prefix {
+				st.encodeRune(nil, int(c), &opts)
+			}
+			before := st
+			if seq := st.encodeRune(nil, int(ch), &opts); len(seq) != 2 {
+				t.Errorf("'%c' after '%v' encoded as %v", ch, prefix, hexString(seq))
+			}
+			if st != before {
+				t.Errorf("'%c' after '%v' changed state from %+v to %+v", ch, prefix, before, st)
+			}
+		}
+	}
+}
+
+func TestHistogram(t *testing.T) {
+	str := "Привет, мир! 🔥🔥"
+	hist := Histogram(str)
+	if hist['р'] != 2 || hist['🔥'] != 2 || hist[' '] != 2 || hist['П'] != 1 || len(hist) != 11 {
+		t.Errorf("Unexpected histogram %v", hist)
+	}
+	blocks := BlockHistogram(str)
+	if blocks[0x0000] != 4 || blocks[0x0400] != 9 || blocks[0x1F500] != 2 || len(blocks) != 3 {
+		t.Errorf("Unexpected block histogram %v", blocks)
+	}
+	if len(Histogram("")) != 0 || len(BlockHistogram("")) != 0 {
+		t.Errorf("Expected empty histograms for an empty string")
+	}
+	// The most frequent block can be passed to SuggestAuxOffset
+	if offs := SuggestAuxOffset(str, 0x0400); offs != 0x0403 {
+		t.Errorf("Suggested 0x%04X", offs)
+	}
+}
+
+func TestSizeClass(t *testing.T) {
+	for _, test := range []struct {
+		str        string
+		n1, n2, n3 int
+	}{
+		{"", 0, 0, 0},
+		{"hello", 5, 0, 0},
+		{"Привет, мир!", 10, 2, 0},
+		{"日本語🔥", 0, 3, 1},
+	} {
+		if n1, n2, n3 := SizeClass(test.str); n1 != test.n1 || n2 != test.n2 || n3 != test.n3 {
+			t.Errorf("SizeClass(%q) = %d, %d, %d, expected %d, %d, %d", test.str, n1, n2, n3, test.n1, test.n2, test.n3)
+		}
+	}
+	strs := append([]string{}, testStrings...)
+	for _, str := range benchmarkScripts {
+		strs = append(strs, str)
+	}
+	for _, str := range strs {
+		n1, n2, n3 := SizeClass(str)
+		if n1+2*n2+3*n3 != EncodedLen(str) || n1+n2+n3 != utf8.RuneCountInString(str) {
+			t.Errorf("SizeClass(%q) = %d, %d, %d, but EncodedLen is %d", str, n1, n2, n3, EncodedLen(str))
+		}
+	}
+}
+
+func TestCorpusSavings(t *testing.T) {
+	corpus := []string{"Hello", "Привет", "Γειά", "日本語", "🔥🔥", ""}
+	// 5+12+8+9+8 bytes in UTF-8, 5+7+5+7+4 in UTF-C
+	if utfcTotal, utf8Total := CorpusSavings(corpus); utfcTotal != 28 || utf8Total != 42 {
+		t.Errorf("CorpusSavings = %v, %v, expected 28, 42", utfcTotal, utf8Total)
+	}
+	if utfcTotal, utf8Total := CorpusSavings(nil); utfcTotal != 0 || utf8Total != 0 {
+		t.Errorf("CorpusSavings of an empty corpus = %v, %v", utfcTotal, utf8Total)
+	}
+}
+
+func TestMin21BitBoundary(t *testing.T) {
+	for _, test := range []struct {
+		str string
+		buf []byte
+	}{
+		// U+27FF is the last character of the first extra range, U+2800 (Braille blank) is the first 21-bit one
+		{"⟿", []byte{0xB8, 0xFF}},
+		{"⠀", []byte{0xA0, 0x00, 0x00}},
+		{"⠁", []byte{0xA0, 0x00, 0x01}},
+		{"⟿⠀⠁⟿⠀", []byte{0xB8, 0xFF, 0xA0, 0x00, 0x00, 0x00, 0x01, 0xB8, 0xFF, 0x00, 0x00}},
+		{"⠀⟿", []byte{0xA0, 0x00, 0x00, 0xB8, 0xFF}},
+		{"Ж⠀⠁", []byte{0x84, 0x16, 0xA0, 0x00, 0x00, 0x00, 0x01}},
+	} {
+		buf := Encode(test.str)
+		if !bytes.Equal(buf, test.buf) {
+			t.Errorf("String %+q encoded as %v, expected %v", test.str, hexString(buf), hexString(test.buf))
+		}
+		if ctrl, err := DecodeSafe(buf); err != nil || ctrl != test.str {
+			t.Errorf("String %+q decoded back as %+q (%v)", test.str, ctrl, err)
+		}
+	}
+
+	// Every character around the seam, from the initial state and from the first 21-bit alphabet
+	opts := Options{}
+	for cp := 0x2000; cp < 0x3100; cp++ {
+		st := initState()
+		n := len(st.encodeRune(nil, cp, &opts))
+		if cp < min21BitCp || inRanges(cp, [][]int{rangeHK}) {
+			if n != 2 {
+				t.Errorf("U+%04X is encoded in %v bytes, expected 2", cp, n)
+			}
+		} else if n != 3 || st.offs != 0 || !st.is21Bit {
+			t.Errorf("U+%04X is encoded in %v bytes, state %+v", cp, n, st)
+		}
+		str := string([]rune{rune(cp), 0x2800, rune(cp), 0x27FF, rune(cp)})
+		if ctrl, err := DecodeSafe(Encode(str)); err != nil || ctrl != str {
+			t.Errorf("String %+q decoded back as %+q (%v)", str, ctrl, err)
+		}
+	}
+}
+
+func TestEncodeConcat(t *testing.T) {
+	// Each part switches to another script
+	parts := []string{"Hello, ", "мир", "! ", "世界", "、", "こんにちは", " 🔥", "שלום", "", "Ελλάδα", "𝄞", "abc"}
+	joined := strings.Join(parts, "")
+	buf := EncodeConcat(parts...)
+	if !bytes.Equal(buf, Encode(joined)) {
+		t.Errorf("Parts encoded as %v, expected %v", hexString(buf), hexString(Encode(joined)))
+	}
+	if ctrl := Decode(buf); ctrl != joined {
+		t.Errorf("Parts decoded back as '%v'", ctrl)
+	}
+	// Concatenating separate encodings doesn't decode to the concatenation of strings
+	var separate []byte
+	for _, part := range parts {
+		separate = append(separate, Encode(part)...)
+	}
+	if Decode(separate) == joined {
+		t.Errorf("Separately encoded parts are not expected to decode correctly")
+	}
+	if len(EncodeConcat()) != 0 || !bytes.Equal(EncodeConcat("Мир"), Encode("Мир")) {
+		t.Errorf("Unexpected encoding of trivial concatenations")
+	}
+	// Any split point between characters gives the same result
+	for i := range joined {
+		if utf8.RuneStart(joined[i]) && !bytes.Equal(EncodeConcat(joined[:i], joined[i:]), Encode(joined)) {
+			t.Errorf("Split at %v encoded as %v", i, hexString(EncodeConcat(joined[:i], joined[i:])))
+		}
+	}
+}
+
+func TestMinBytes(t *testing.T) {
+	for _, test := range []struct {
+		str string
+		min int
+	}{
+		{"", 0},
+		{"hello", 5},
+		{"Привет", 7},
+		{"ЖaЖbЖ", 2 + 4},
+		{"日本語", 3 + 2 + 2},
+		{"ひらがな", 2 + 2 + 1 + 1},
+		{"🔥🔥", 4},
+	} {
+		if n := MinBytes(test.str); n != test.min {
+			t.Errorf("MinBytes(%q) = %d, expected %d", test.str, n, test.min)
+		}
+	}
+	// The bound must hold for any string, including ones alternating between many alphabets
+	pool := []rune("aZ ,éЖжαאم日本ひカ🔥😀⟿⠀\u200d𝄞")
+	rnd := rand.New(rand.NewSource(1))
+	strs := append([]string{}, testStrings...)
+	for _, str := range benchmarkScripts {
+		strs = append(strs, str)
+	}
+	for i := 0; i < 1000; i++ {
+		runes := make([]rune, rnd.Intn(20))
+		for j := range runes {
+			runes[j] = pool[rnd.Intn(len(pool))]
+		}
+		strs = append(strs, string(runes))
+	}
+	for _, str := range strs {
+		if min, n := MinBytes(str), EncodedLen(str); min > n {
+			t.Errorf("MinBytes(%q) = %d exceeds EncodedLen %d", str, min, n)
+		}
+	}
+}
+
+func TestSwitchCount(t *testing.T) {
+	for _, test := range []struct {
+		str string
+		n   int
+	}{
+		{"", 0},
+		{"abc", 0},
+		{"Привет мир", 1},   // Spaces are in the Latin auxiliary alphabet
+		{"Привет, мир!", 2}, // Comma switches to Latin, then Cyrillic is the auxiliary alphabet
+		{"aЖaЖ", 1},         // Latin letters after Cyrillic use the auxiliary alphabet
+		{"日本語🔥ひらがな", 3},     // Emojis don't change the alphabet
+	} {
+		if n := SwitchCount(test.str); n != test.n {
+			t.Errorf("SwitchCount(%q) = %v, expected %v", test.str, n, test.n)
+		}
+	}
+}
+
+func TestBlocksUsed(t *testing.T) {
+	tests := []struct {
+		str      string
+		expected []int
+	}{
+		{"", nil},
+		{"abc", []int{0x0000}},
+		{"Привет", []int{0x0400}},
+		{"Привет, мир!", []int{0x0400, 0x0000}},
+		{"Hello, Привет, Γειά", []int{0x0000, 0x0400, 0x0380}},
+		{"中文 and ひらがな", []int{0x2800, 0x3000, 0x3080}},
+		{"😀é", nil},
+	}
+	for _, test := range tests {
+		if blocks := BlocksUsed(test.str); fmt.Sprintf("%#x", blocks) != fmt.Sprintf("%#x", test.expected) {
+			t.Errorf("String '%v' uses alphabets %#x, expected %#x", test.str, blocks, test.expected)
+		}
+	}
+	for _, test := range testStrings {
+		if n := len(BlocksUsed(test)); n > SwitchCount(test)+1 {
+			t.Errorf("String '%v' uses %v alphabets with %v switches", test, n, SwitchCount(test))
+		}
+	}
+}
+
+func TestMinSwitches(t *testing.T) {
+	tests := []struct {
+		str           string
+		min, switches int
+	}{
+		{"", 0, 0},
+		{"Hello", 0, 0},
+		{"Привет", 1, 1},
+		{"Привет, мир!", 1, 2},
+		{"Hello Привет", 1, 1},
+		{"Пé", 1, 2}, // "é" switches to Latin after Cyrillic,
+		{"éП", 1, 1}, // but it's in the initial auxiliary alphabet before it
+		{"ΑЖאΑЖאΑЖא", 3, 9},
+		{"ΑΑΑЖЖЖאאא", 3, 3},
+		{"中ひ中ひ中ひ", 2, 6},
+		{"中中中ひひひ", 2, 2},
+	}
+	for _, test := range tests {
+		if n, switches := MinSwitches(test.str), SwitchCount(test.str); n != test.min || switches != test.switches {
+			t.Errorf("String '%v' needs %v switches of %v, expected %v of %v", test.str, n, switches, test.min, test.switches)
+		}
+	}
+	for _, test := range testStrings {
+		if n := MinSwitches(test); n > SwitchCount(test) {
+			t.Errorf("String '%v' needs %v switches, but only %v are made", test, n, SwitchCount(test))
+		}
+	}
+}
+
+func TestAdvise(t *testing.T) {
+	for _, test := range []struct {
+		str   string
+		hints []string
+	}{
+		{"", nil},
+		{"Hello, world!", nil},
+		{"Привет мир", nil},
+		{"Привет, мир! Как дела?", []string{"spaces and ASCII punctuation inside non-Latin text add 1 byte; consider native punctuation or grouping scripts"}},
+		{"日本語ひらがな日本語ひらがな日本語", []string{"switches back to used alphabets add 4 bytes, most of all Han/Hiragana alternation (3 bytes); consider grouping scripts"}},
+		{"日本語のは日本語のは日本語", []string{"frequent Han/Hiragana alternation adds 3 bytes; consider grouping scripts"}},
+		{"ΑαЖжΑαЖжΑα", nil}, // Two alternating scripts are kept in the current and auxiliary alphabets
+		{"Αα Жж Αα Жж", []string{"spaces and ASCII punctuation inside non-Latin text add 2 bytes; consider native punctuation or grouping scripts"}},
+		{"ΑЖאΑЖאΑЖא", []string{"switches back to used alphabets add 6 bytes, most of all Cyrillic/Greek alternation (2 bytes); consider grouping scripts"}},
+	} {
+		if hints := Advise(test.str); fmt.Sprintf("%q", hints) != fmt.Sprintf("%q", test.hints) {
+			t.Errorf("Advise(%q) = %q, expected %q", test.str, hints, test.hints)
+		}
+	}
+}
+
+func TestDecodeLast(t *testing.T) {
+	strs := append([]string{"Привет日本語🔥мир abc ひらがな \U0010FFFF Ελλάδα"}, testStrings...)
+	for _, str := range strs {
+		runes := []rune(str)
+		buf := Encode(str)
+		for _, n := range []int{1, 2, 3, 5, 7, len(runes) - 1, len(runes), len(runes) + 1, 100} {
+			if n <= 0 {
+				continue
+			}
+			expected := runes
+			if n < len(runes) {
+				expected = runes[len(runes)-n:]
+			}
+			if tail, err := DecodeLast(buf, n); err != nil || tail != string(expected) {
+				t.Errorf("Last %v characters of '%v' decoded as '%v' (%v), expected '%v'", n, str, tail, err, string(expected))
+			}
+		}
+	}
+	if tail, err := DecodeLast(Encode("abc"), 0); err != nil || tail != "" {
+		t.Errorf("Expected an empty string for n = 0, got '%v' (%v)", tail, err)
+	}
+	var decodeErr *DecodeError
+	if _, err := DecodeLast([]byte{'a', 'b', 0xBF, 0xFF, 'c'}, 1); !errors.As(err, &decodeErr) || decodeErr.Offset != 2 || decodeErr.Err != ErrInvalid {
+		t.Errorf("Expected ErrInvalid at offset 2, got %v", err)
+	}
+	if _, err := DecodeLast([]byte{'a', marker21Bit}, 1); !errors.Is(err, ErrTruncated) {
+		t.Errorf("Expected ErrTruncated, got %v", err)
+	}
+}
+
+func BenchmarkDecodeLast(b *testing.B) {
+	buf := Encode(strings.Repeat(benchmarkScripts["Cyrillic"], 20))
+	b.SetBytes(int64(len(buf)))
+	for i := 0; i < b.N; i++ {
+		DecodeLast(buf, 80)
+	}
+}
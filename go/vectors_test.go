@@ -0,0 +1,107 @@
+package utfc
+
+import (
+	"encoding/hex"
+	"encoding/json"
+	"flag"
+	"io/ioutil"
+	"path/filepath"
+	"testing"
+)
+
+var update = flag.Bool("update", false, "regenerate testdata/vectors.json from the current implementation")
+
+const vectorsFile = "vectors.json"
+
+type vector struct {
+	Comment string `json:"comment,omitempty"`
+	Str     string `json:"str"`
+	UTFC    string `json:"utfc"`
+}
+
+// vectorInputs lists the strings for testdata/vectors.json, covering every branch of the encoder and the boundaries of ranges
+func vectorInputs() []vector {
+	inputs := []vector{
+		{Comment: "empty string", Str: ""},
+		{Comment: "ASCII is encoded as is", Str: "Hello, World!\x00\x7F"},
+		{Comment: "initial auxiliary alphabet U+00C0-U+00FF", Str: "àéÿ"},
+		{Comment: "Latin-1 below the auxiliary alphabet takes 2 bytes and makes Latin auxiliary", Str: "a¡b"},
+		{Comment: "Latin Extended always takes 2 bytes, since offs stays 0", Str: "ĀɏʯȀ"},
+		{Comment: "Latin becomes the remapped auxiliary alphabet", Str: "Мир abc-XYZ 0189"},
+		{Comment: "Latin auxiliary alphabet doesn't include punctuation", Str: "Мир!"},
+		{Comment: "13-bit switch stores the remapped auxiliary window", Str: "Жш Ж"},
+		{Comment: "character in both auxiliary and current alphabets uses the auxiliary one", Str: "Мир©é"},
+		{Comment: "Hiragana and Katakana are extra ranges that change the alphabet", Str: "ひらがなカタカナ"},
+		{Comment: "extra ranges outside of Hiragana and Katakana don't change the alphabet", Str: "Мир₠\u200F🔥м"},
+		{Comment: "21-bit switch and characters in the current 21-bit alphabet", Str: "中文한국어"},
+		{Comment: "21-bit switch stores offs without remapping", Str: "Ж𝄞Ѐ"},
+		{Comment: "two different 21-bit alphabets", Str: "Ж中𝄞a"},
+		{Comment: "leaving a 21-bit alphabet", Str: "中Жa"},
+		{Comment: "alternating 21-bit and 13-bit characters", Str: "𝄞Ж𝄞Ж𝄞Ж"},
+		{Comment: "replacement character", Str: "�"},
+	}
+	// Boundaries of ranges, both from the initial state and after switching to other alphabets
+	boundaries := []rune{
+		0x007F, 0x0080, 0x00BF, 0x00C0, 0x00FF, 0x0100, 0x02FF, 0x0300, 0x0400, 0x041F, 0x0420, 0x07FF,
+		0x1FFF, 0x2000, 0x27FF, 0x2800, 0x2FFF, 0x3000, 0x30FF, 0x3100, 0xA7FF, 0xA800, 0xD7FF, 0xE000,
+		0xFDFF, 0xFE00, 0xFE0F, 0xFE10, 0xFFFF, 0x10000, 0x1F16F, 0x1F170, 0x1F1FF, 0x1F200,
+		0x1F2FF, 0x1F300, 0x1F6FF, 0x1F700, 0x1F8FF, 0x1F900, 0x1F9FF, 0x1FA00, 0x10FFFF,
+	}
+	for _, prefix := range []string{"", "a", "Ж", "中"} {
+		for _, ch := range boundaries {
+			inputs = append(inputs, vector{Str: prefix + string(ch) + string(ch)})
+		}
+	}
+	for _, str := range testStrings {
+		inputs = append(inputs, vector{Str: str})
+	}
+	return inputs
+}
+
+func TestVectorFile(t *testing.T) {
+	path := filepath.Join("testdata", vectorsFile)
+	if *update {
+		vectors := vectorInputs()
+		for i := range vectors {
+			vectors[i].UTFC = hex.EncodeToString(Encode(vectors[i].Str))
+		}
+		data, err := json.MarshalIndent(vectors, "", "  ")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := ioutil.WriteFile(path, append(data, '\n'), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	vectors := readVectors(t)
+	if len(vectors) != len(vectorInputs()) {
+		t.Errorf("%v has %v vectors, expected %v (run go test -update to regenerate)", path, len(vectors), len(vectorInputs()))
+	}
+	for _, v := range vectors {
+		buf, err := hex.DecodeString(v.UTFC)
+		if err != nil {
+			t.Errorf("Vector '%v' has invalid hex: %v", v.Str, err)
+			continue
+		}
+		if enc := Encode(v.Str); hex.EncodeToString(enc) != v.UTFC {
+			t.Errorf("String '%v' encoded as %v, expected %v", v.Str, hexString(enc), v.UTFC)
+		}
+		if str, err := DecodeSafe(buf); err != nil || str != v.Str {
+			t.Errorf("Bytes %v decoded as '%v' (%v), expected '%v'", v.UTFC, str, err, v.Str)
+		}
+	}
+}
+
+// readVectors loads testdata/vectors.json
+func readVectors(t *testing.T) []vector {
+	data, err := ioutil.ReadFile(filepath.Join("testdata", vectorsFile))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var vectors []vector
+	if err := json.Unmarshal(data, &vectors); err != nil {
+		t.Fatal(err)
+	}
+	return vectors
+}
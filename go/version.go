@@ -0,0 +1,131 @@
+package utfc
+
+import "errors"
+
+// FormatVersion is a revision of the wire format. There's only one so far, the format of the original
+// JS implementation (utf-c 1.0). If it ever changes, a new version gets its own state machine (initStateV2,
+// encodeRuneV2 and decodeRuneV2) and an entry in formats, and becomes current, while older versions stay
+// available to decode their data via DecodeVersion.
+//
+// Versions differ at the level of a single character: every function of the package encodes and decodes via
+// state.encodeRune, state.decodeRune and initState (or their variants for a given version, in DecodeVersion),
+// so none of them can produce or expect another version.
+type FormatVersion int
+
+const (
+	FormatV1 FormatVersion = iota + 1
+)
+
+// ErrUnknownFormat is returned by DecodeVersion for versions that don't exist
+var ErrUnknownFormat = errors.New("utfc: unknown format version")
+
+// currentFormat is the version produced and expected by all functions of the package (except DecodeVersion).
+// It's a variable only so that tests can simulate the addition of a newer version.
+var currentFormat = FormatV1
+
+// format is the state machine of a format version, along with the properties that allow shortcuts.
+// The state and options are passed by value, so that calling these functions doesn't make them escape to the heap.
+type format struct {
+	asciiAsIs  bool // Whether ASCII text is encoded as is
+	initState  func() state
+	encodeRune func(st state, cp int, opts Options) (state, []byte)
+	decodeRune func(st state, buf []byte, i int, opts Options) (state, int, int, error)
+}
+
+// formats is indexed by FormatVersion
+var formats = []format{
+	FormatV1: {
+		asciiAsIs: true,
+		initState: initStateV1,
+		encodeRune: func(st state, cp int, opts Options) (state, []byte) {
+			seq := st.encodeRuneV1(nil, cp, &opts)
+			return st, seq
+		},
+		decodeRune: func(st state, buf []byte, i int, opts Options) (state, int, int, error) {
+			cp, n, err := st.decodeRuneV1(buf, i, &opts)
+			return st, cp, n, err
+		},
+	},
+}
+
+// known reports whether v is one of the registered versions
+func (v FormatVersion) known() bool {
+	return v > 0 && int(v) < len(formats) && formats[v].initState != nil
+}
+
+// The following functions dispatch to the state machine of a given version. V1 is called directly, since calls
+// via function values are slower and make everything passed by pointer escape to the heap.
+
+// initStateOf returns the initial state of the format version v
+func initStateOf(v FormatVersion) state {
+	if v == FormatV1 {
+		return initStateV1()
+	}
+	return formats[v].initState()
+}
+
+// encodeRuneOf appends the encoding of a single character in the format version v to buf and updates the state
+func (st *state) encodeRuneOf(v FormatVersion, buf []byte, cp int, opts *Options) []byte {
+	if v == FormatV1 {
+		return st.encodeRuneV1(buf, cp, opts)
+	}
+	return st.encodeRuneVia(v, buf, cp, opts)
+}
+
+// encodeRuneVia is the slow path of encodeRuneOf, calling the state machine from formats. It's separate
+// so that encodeRuneOf can be inlined.
+func (st *state) encodeRuneVia(v FormatVersion, buf []byte, cp int, opts *Options) []byte {
+	next, seq := formats[v].encodeRune(*st, cp, *opts)
+	*st = next
+	return append(buf, seq...)
+}
+
+// decodeRuneOf decodes a single character in the format version v starting at buf[i] and updates the state.
+// It returns the decoded value and the length of its sequence.
+func (st *state) decodeRuneOf(v FormatVersion, buf []byte, i int, opts *Options) (int, int, error) {
+	if v == FormatV1 {
+		return st.decodeRuneV1(buf, i, opts)
+	}
+	return st.decodeRuneVia(v, buf, i, opts)
+}
+
+// decodeRuneVia is the slow path of decodeRuneOf, see encodeRuneVia
+func (st *state) decodeRuneVia(v FormatVersion, buf []byte, i int, opts *Options) (int, int, error) {
+	next, cp, n, err := formats[v].decodeRune(*st, buf, i, *opts)
+	*st = next
+	return cp, n, err
+}
+
+// initState returns the initial state of the current format version
+func initState() state {
+	return initStateOf(currentFormat)
+}
+
+// encodeRune appends the encoding of a single character in the current format version to buf and updates the state
+func (st *state) encodeRune(buf []byte, cp int, opts *Options) []byte {
+	return st.encodeRuneOf(currentFormat, buf, cp, opts)
+}
+
+// decodeRune decodes a single character in the current format version starting at buf[i] and updates the state.
+// It returns the decoded value and the length of its sequence.
+func (st *state) decodeRune(buf []byte, i int, opts *Options) (int, int, error) {
+	return st.decodeRuneOf(currentFormat, buf, i, opts)
+}
+
+// asciiAsIs reports whether str is ASCII and the current format version encodes it as is
+func asciiAsIs(str string) bool {
+	return formats[currentFormat].asciiAsIs && isASCII(str)
+}
+
+// DecodeVersion converts UTF-C byte array encoded in the format version v to a string, like DecodeSafe does
+// for the current version. It allows to read data stored before the format changed.
+func DecodeVersion(buf []byte, v FormatVersion) (string, error) {
+	if !v.known() {
+		return "", ErrUnknownFormat
+	}
+	out := make([]byte, 0, len(buf))
+	err := decodeEach(buf, v, &Options{}, func(cp int) {
+		out = appendRune(out, cp)
+	})
+	return string(out), err
+}
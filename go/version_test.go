@@ -0,0 +1,147 @@
+package utfc
+
+import (
+	"bytes"
+	"encoding/hex"
+	"go/ast"
+	"go/parser"
+	"go/token"
+	"io/ioutil"
+	"os"
+	"strings"
+	"testing"
+)
+
+func TestFormatVersions(t *testing.T) {
+	// State machines of specific versions may only be referenced by the format table, so no function
+	// can bypass the dispatch to the current version
+	fset := token.NewFileSet()
+	pkgs, err := parser.ParseDir(fset, ".", func(fi os.FileInfo) bool { return !strings.HasSuffix(fi.Name(), "_test.go") }, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	versioned := map[string]bool{"initStateV1": true, "encodeRuneV1": true, "decodeRuneV1": true}
+	for _, pkg := range pkgs {
+		for name, file := range pkg.Files {
+			ast.Inspect(file, func(node ast.Node) bool {
+				if decl, ok := node.(*ast.FuncDecl); ok {
+					ast.Inspect(decl.Body, func(node ast.Node) bool {
+						if id, ok := node.(*ast.Ident); ok && versioned[id.Name] && !strings.HasSuffix(name, "version.go") {
+							t.Errorf("%v: %v is used directly", fset.Position(id.Pos()), id.Name)
+						}
+						return true
+					})
+					return false
+				}
+				return true
+			})
+		}
+	}
+
+	// All entry points produce and accept the current version
+	if currentFormat != FormatV1 {
+		t.Fatalf("Reference encoder below is for v1, current version is v%v", currentFormat)
+	}
+	for _, test := range testStrings {
+		st := initStateV1()
+		var expected []byte
+		for _, ch := range test {
+			expected = st.encodeRuneV1(expected, int(ch), &Options{})
+		}
+		var w bytes.Buffer
+		enc := NewEncoder(&w)
+		enc.Write([]byte(test))
+		enc.Close()
+		column, _ := EncodeColumn(State{}, test)
+		withOpts, _ := EncodeWith(test, Options{})
+		lines, _ := EncodeWithLines(test)
+		var sink bytes.Buffer
+		EncodeInto(&sink, test)
+		for name, buf := range map[string][]byte{
+			"Encode": Encode(test), "AppendEncode": AppendEncode(nil, test), "EncodeWith": withOpts,
+			"EncodeConcat": EncodeConcat(test), "Encoder": w.Bytes(), "EncodeColumn": column,
+			"EncodeWithLines": lines, "EncodeInto": sink.Bytes(),
+		} {
+			if !bytes.Equal(buf, expected) {
+				t.Errorf("%v encoded '%v' as %v, expected %v", name, test, hexString(buf), hexString(expected))
+			}
+		}
+		if n := EncodedLen(test); n != len(expected) {
+			t.Errorf("EncodedLen of '%v' is %v, expected %v", test, n, len(expected))
+		}
+
+		safe, _ := DecodeSafe(expected)
+		decodedWith, _ := DecodeWith(expected, Options{})
+		upTo, _ := DecodeUpTo(expected)
+		decodedColumn, _ := DecodeColumn(State{}, expected)
+		stream, _ := ioutil.ReadAll(NewDecoder(bytes.NewReader(expected)))
+		for name, str := range map[string]string{
+			"Decode": Decode(expected), "DecodeSafe": safe, "DecodeWith": decodedWith,
+			"DecodeUpTo": upTo, "DecodeColumn": decodedColumn, "Decoder": string(stream),
+		} {
+			if str != test {
+				t.Errorf("%v decoded '%v' as '%v'", name, test, str)
+			}
+		}
+	}
+}
+
+func TestFormatUpgrade(t *testing.T) {
+	// Simulate a v2 that assigns different marker bytes: every byte with the high bit set is XORed with 0x40,
+	// so that 13-bit sequences start with 0xC0-0xDF, characters of the auxiliary alphabet become 0x80-0xBF, etc.
+	const formatV2 = FormatV1 + 1
+	swap := func(seq []byte) []byte {
+		out := make([]byte, len(seq))
+		for i, b := range seq {
+			if b >= 0x80 {
+				b ^= 0x40
+			}
+			out[i] = b
+		}
+		return out
+	}
+	v1 := formats[FormatV1]
+	savedFormats, savedCurrent := formats, currentFormat
+	defer func() {
+		formats, currentFormat = savedFormats, savedCurrent
+	}()
+	formats = append(formats[:len(formats):len(formats)], format{
+		asciiAsIs: true,
+		initState: v1.initState,
+		encodeRune: func(st state, cp int, opts Options) (state, []byte) {
+			st, seq := v1.encodeRune(st, cp, opts)
+			return st, swap(seq)
+		},
+		decodeRune: func(st state, buf []byte, i int, opts Options) (state, int, int, error) {
+			end := i + 3 // No sequence is longer
+			if end > len(buf) {
+				end = len(buf)
+			}
+			return v1.decodeRune(st, swap(buf[i:end]), 0, opts)
+		},
+	})
+	currentFormat = formatV2
+
+	for _, v := range readVectors(t) {
+		buf, err := hex.DecodeString(v.UTFC)
+		if err != nil {
+			t.Fatalf("Vector '%v' has invalid hex: %v", v.Str, err)
+		}
+		if str, err := DecodeVersion(buf, FormatV1); err != nil || str != v.Str {
+			t.Errorf("v1 bytes %v decoded as '%v' (%v), expected '%v'", v.UTFC, str, err, v.Str)
+		}
+		enc := Encode(v.Str)
+		if !bytes.Equal(enc, swap(buf)) {
+			t.Errorf("String '%v' encoded as %v, expected v2 bytes %v", v.Str, hexString(enc), hexString(swap(buf)))
+		}
+		if str, err := DecodeSafe(enc); err != nil || str != v.Str {
+			t.Errorf("v2 bytes %v decoded as '%v' (%v), expected '%v'", hexString(enc), str, err, v.Str)
+		}
+		if str, err := DecodeVersion(enc, formatV2); err != nil || str != v.Str {
+			t.Errorf("v2 bytes %v decoded by version as '%v' (%v), expected '%v'", hexString(enc), str, err, v.Str)
+		}
+	}
+	if _, err := DecodeVersion(nil, formatV2+1); err != ErrUnknownFormat {
+		t.Errorf("Unknown version returned %v, expected ErrUnknownFormat", err)
+	}
+}